@@ -0,0 +1,274 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// exit codes of the subcommands, 3 is what an init script's status uses for
+// a service that is not running
+const (
+	exitFailure    = 1
+	exitUsage      = 2
+	exitNotRunning = 3
+)
+
+var errNotRunning = errors.New("not running")
+
+// usageError is returned when a subcommand is called the wrong way
+type usageError string
+
+func (e usageError) Error() string {
+	return "usage: " + string(e)
+}
+
+const usage = `usage: sshtunnel <command> [arguments]
+
+commands:
+  list                          list every tunnel with its host and forwards
+  start <name>                  start a tunnel and what it depends on
+  stop <name> [-cascade]        stop a tunnel, and with -cascade what depends on it
+  restart <name>                restart a tunnel
+  status [name] [-json]         show the state of every tunnel or of one
+  group <command> <group>       start, stop, restart or show every member of a group
+  logs <name> [-n 100] [-follow]
+  validate [name]
+  show <name> [-resolved]       print a config, with -resolved as it is used
+  migrate [-dry-run]            rewrite older configs in the latest schema, keeping backups
+  import-ssh-config [-f file] [-bind address] [-force] [host...]
+  export-ssh-config [-include] [-o file] [name...]
+  daemon [-metrics address]     run the supervisor that owns the tunnels
+  alias                         alias the bind addresses that aren't on the loopback interface yet
+  alfred [query]                answer Alfred's script filter with the tunnels that match query
+  help                          show this
+`
+
+// exitCode returns the exit code for an error returned by a subcommand
+func exitCode(err error) int {
+	switch err.(type) {
+	case usageError:
+		return exitUsage
+	}
+	if err == errNotRunning {
+		return exitNotRunning
+	}
+	return exitFailure
+}
+
+// printStatuses prints a table with a row for every tunnel
+func printStatuses(dataPath, configPath string, statuses []tunnelStatus) {
+	healths := runningHealth(configPath, statusMap(statuses))
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tSTATE\tHEALTH\tPID\tUPTIME\tDETAILS")
+	for _, tunnel := range statuses {
+		health, pid, uptime := "-", "-", "-"
+		if tunnel.running() {
+			if h, ok := healths[tunnel.Name]; ok {
+				health = h.String()
+			}
+			uptime = formatUptime(time.Since(tunnel.Since))
+		}
+		if tunnel.PID > 0 {
+			pid = fmt.Sprint(tunnel.PID)
+		}
+
+		details := []string{}
+		if len(tunnel.LastError) > 0 {
+			details = append(details, tunnel.LastError)
+		}
+		if tunnel.ConfigChanged {
+			details = append(details, "config changed, restart to apply")
+		}
+		if events, err := readHistory(dataPath, tunnel.Name); err == nil {
+			if summary := historySummary(events); len(summary) > 0 {
+				details = append(details, summary)
+			}
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", tunnel.Name, tunnel.State, health, pid, uptime, strings.Join(details, "; "))
+	}
+	w.Flush()
+}
+
+// statusSchemaVersion changes only when a field of the JSON status is
+// removed or changes its meaning
+const statusSchemaVersion = 1
+
+// jsonStatus is what status -json prints. Every field is always there, empty
+// when it doesn't apply.
+type jsonStatus struct {
+	SchemaVersion int          `json:"schemaVersion"`
+	Tunnels       []jsonTunnel `json:"tunnels"`
+}
+
+type jsonTunnel struct {
+	Name          string        `json:"name"`
+	User          string        `json:"user"`
+	Host          string        `json:"host"`
+	Port          string        `json:"port"`
+	BindAddress   string        `json:"bindAddress"`
+	Forwards      []jsonForward `json:"forwards"`
+	State         string        `json:"state"`
+	Health        string        `json:"health"`
+	PID           int           `json:"pid"`
+	Since         *time.Time    `json:"since"`
+	UptimeSeconds int64         `json:"uptimeSeconds"`
+	LastError     string        `json:"lastError"`
+	ConfigChanged bool          `json:"configChanged"`
+}
+
+// jsonForward is a forward of a tunnel, Type is local, remote or dynamic
+type jsonForward struct {
+	Type   string `json:"type"`
+	Listen string `json:"listen"`
+	Target string `json:"target"`
+	Label  string `json:"label"`
+}
+
+// printStatusesJSON prints the state of tunnels in the schema of jsonStatus
+func printStatusesJSON(configPath string, statuses []tunnelStatus) error {
+	healths := runningHealth(configPath, statusMap(statuses))
+	out := jsonStatus{SchemaVersion: statusSchemaVersion, Tunnels: []jsonTunnel{}}
+	for _, status := range statuses {
+		tunnel := jsonTunnel{
+			Name:          status.Name,
+			Forwards:      []jsonForward{},
+			State:         status.State,
+			PID:           status.PID,
+			LastError:     status.LastError,
+			ConfigChanged: status.ConfigChanged,
+		}
+		conf, err := loadConfig(configPath, status.Name)
+		if err == nil {
+			tunnel.User = conf.RemoteUser
+			tunnel.Host = conf.RemoteHost
+			tunnel.Port = conf.RemotePort
+			if len(tunnel.Port) == 0 {
+				tunnel.Port = defaultSSHPort
+			}
+			tunnel.BindAddress = conf.LocalBindAddress
+			tunnel.Forwards = jsonForwards(conf)
+		}
+		if status.running() {
+			since := status.Since
+			tunnel.Since = &since
+			tunnel.UptimeSeconds = int64(time.Since(since) / time.Second)
+			if h, ok := healths[status.Name]; ok {
+				tunnel.Health = h.State
+			}
+		}
+		out.Tunnels = append(out.Tunnels, tunnel)
+	}
+
+	bt, err := json.MarshalIndent(out, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(bt))
+	return nil
+}
+
+func jsonForwards(conf Config) []jsonForward {
+	forwards := []jsonForward{}
+	for _, fw := range conf.forwards() {
+		forwards = append(forwards, jsonForward{Type: "local", Listen: fw.local(), Target: fw.remote(), Label: fw.Label})
+	}
+	for _, fw := range conf.RemoteForwards {
+		forwards = append(forwards, jsonForward{Type: "remote", Listen: fw.remote(), Target: fw.local()})
+	}
+	for _, port := range conf.DynamicForwards {
+		forwards = append(forwards, jsonForward{Type: "dynamic", Listen: net.JoinHostPort(conf.LocalBindAddress, port)})
+	}
+	return forwards
+}
+
+// runningHealth probes every running tunnel whose config can be read
+func runningHealth(configPath string, statuses map[string]tunnelStatus) map[string]health {
+	confs := []Config{}
+	for name, status := range statuses {
+		if !status.running() {
+			continue
+		}
+		if conf, err := loadConfig(configPath, name); err == nil {
+			confs = append(confs, conf)
+		}
+	}
+	return checkHealthAll(confs)
+}
+
+func statusMap(statuses []tunnelStatus) map[string]tunnelStatus {
+	m := map[string]tunnelStatus{}
+	for _, status := range statuses {
+		m[status.Name] = status
+	}
+	return m
+}
+
+// formatUptime rounds a duration to what is worth reading
+func formatUptime(d time.Duration) string {
+	switch {
+	case d < time.Minute:
+		return d.Round(time.Second).String()
+	case d < time.Hour:
+		return fmt.Sprintf("%dm", int(d.Minutes()))
+	}
+	return fmt.Sprintf("%dh%02dm", int(d.Hours()), int(d.Minutes())%60)
+}
+
+// runList prints a table of every config with where it connects to, what
+// it forwards and its state
+func runList(dataPath, configPath string) error {
+	names, err := configNames(configPath)
+	if err != nil {
+		return err
+	}
+	statuses, err := currentStatus(dataPath, configPath)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tDESTINATION\tBIND\tFORWARDS\tSTATE")
+	for _, name := range names {
+		conf, err := loadConfig(configPath, name)
+		if err != nil {
+			fmt.Fprintf(w, "%s\t-\t-\t-\t%s\n", name, strings.TrimPrefix(err.Error(), name+": "))
+			continue
+		}
+		destination := conf.RemoteUser + "@" + conf.RemoteHost
+		if len(conf.RemotePort) > 0 {
+			destination += ":" + conf.RemotePort
+		}
+		state := statuses[name].State
+		if len(state) == 0 {
+			state = stateOff
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", name, destination, conf.LocalBindAddress, strings.Join(forwardSpecs(conf), ", "), state)
+	}
+	return w.Flush()
+}
+
+// forwardSpecs describes every forward of a config the way ssh takes them
+func forwardSpecs(conf Config) []string {
+	specs := []string{}
+	for _, fw := range conf.forwards() {
+		// a string that isn't a forward is shown as it was written
+		if len(fw.LocalPort) == 0 && len(fw.spec) > 0 {
+			specs = append(specs, "L "+fw.spec)
+			continue
+		}
+		specs = append(specs, "L "+fw.LocalPort+":"+fw.remote())
+	}
+	for _, fw := range conf.RemoteForwards {
+		specs = append(specs, "R "+fw.String())
+	}
+	for _, port := range conf.DynamicForwards {
+		specs = append(specs, "D "+port)
+	}
+	return specs
+}
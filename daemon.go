@@ -0,0 +1,561 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+const (
+	// sun_path holds 104 bytes on macOS, including the terminating NUL
+	maxSocketPath     = 103
+	daemonDialTimeout = time.Second
+	sshSettleTime     = 3 * time.Second
+)
+
+var errDaemonNotRunning = errors.New("daemon is not running")
+
+const (
+	stateOff        = "Off"
+	stateOn         = "On"
+	stateConnecting = "Connecting"
+	// the tunnel gave up reconnecting
+	stateFailed = "Failed"
+)
+
+// request is sent by a client to the daemon over the control socket
+type request struct {
+	Command string `json:"command"`
+	Name    string `json:"name,omitempty"`
+}
+
+// response is the daemon's answer to a request
+type response struct {
+	Error   string         `json:"error,omitempty"`
+	Tunnels []tunnelStatus `json:"tunnels,omitempty"`
+}
+
+// tunnelStatus is the state of a single tunnel as the daemon knows it
+type tunnelStatus struct {
+	Name          string    `json:"name"`
+	State         string    `json:"state"`
+	PID           int       `json:"pid,omitempty"`
+	Since         time.Time `json:"since,omitempty"`
+	LastError     string    `json:"lastError,omitempty"`
+	ConfigChanged bool      `json:"configChanged,omitempty"`
+}
+
+// managedTunnel is a tunnel owned by the daemon. autossh tunnels are run as
+// a plain ssh child process and restarted by the daemon itself, native
+// tunnels run in-process.
+type managedTunnel struct {
+	conf     Config
+	dataPath string
+	stop     chan struct{}
+	done     chan struct{}
+
+	mu      sync.Mutex
+	state   string
+	pid     int
+	since   time.Time
+	lastErr string
+	cmd     *exec.Cmd
+	native  *nativeTunnel
+	log     *tunnelLog
+	metrics *tunnelMetrics
+}
+
+func newManagedTunnel(dataPath string, conf Config) *managedTunnel {
+	return &managedTunnel{
+		conf:     conf,
+		dataPath: dataPath,
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+		state:    stateConnecting,
+		since:    time.Now(),
+		metrics:  newTunnelMetrics(),
+	}
+}
+
+func (m *managedTunnel) run() {
+	defer close(m.done)
+	log, err := openLog(m.dataPath, m.conf.Name)
+	if err == nil {
+		m.log = log
+		defer log.Close()
+	}
+	err = supervise(m.dataPath, m.conf, m.stop, m.log, m.connect)
+	if err != nil {
+		m.mu.Lock()
+		m.state = stateFailed
+		m.lastErr = err.Error()
+		m.mu.Unlock()
+	}
+}
+
+// finished tells if the tunnel gave up reconnecting
+func (m *managedTunnel) finished() bool {
+	select {
+	case <-m.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// connect runs one connection attempt and blocks until it ends
+func (m *managedTunnel) connect(connected func()) (err error) {
+	defer func() {
+		m.mu.Lock()
+		m.state = stateConnecting
+		m.pid = 0
+		m.since = time.Now()
+		m.cmd = nil
+		m.native = nil
+		if err != nil {
+			m.lastErr = err.Error()
+		}
+		m.mu.Unlock()
+	}()
+
+	m.mu.Lock()
+	select {
+	case <-m.stop:
+		m.mu.Unlock()
+		return nil
+	default:
+	}
+	atomic.AddInt64(&m.metrics.connects, 1)
+
+	if m.conf.Backend == backendNative {
+		tunnel := newNativeTunnel(m.conf)
+		tunnel.onConnect = func() {
+			m.mu.Lock()
+			m.state = stateOn
+			m.pid = os.Getpid()
+			m.since = time.Now()
+			m.mu.Unlock()
+			connected()
+		}
+		tunnel.log = m.log
+		tunnel.metrics = m.metrics
+		m.native = tunnel
+		m.mu.Unlock()
+		return tunnel.Run()
+	}
+
+	cmd := exec.Command("ssh", append([]string{"-N", "-o", "BatchMode=yes", "-o", "ExitOnForwardFailure=yes"}, sshArgs(m.conf)...)...)
+	cmd.Stdout = m.log
+	cmd.Stderr = m.log
+	// a group of its own, so stopProcess can stop it from its record if the
+	// daemon is gone
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	err = cmd.Start()
+	if err != nil {
+		m.mu.Unlock()
+		return err
+	}
+	m.cmd = cmd
+	m.pid = cmd.Process.Pid
+	m.mu.Unlock()
+
+	// recorded so the tunnel can still be found if the daemon dies
+	writeRecord(m.dataPath, record{
+		Name:       m.conf.Name,
+		PID:        cmd.Process.Pid,
+		StartTime:  time.Now(),
+		ConfigHash: configHash(m.conf),
+		Argv:       cmd.Args,
+	})
+	defer removeRecord(m.dataPath, m.conf.Name)
+
+	// ssh exits right away when it can't connect or forward, so it is only
+	// taken as connected once it has kept running for a while
+	waitc := make(chan error, 1)
+	go func() {
+		waitc <- cmd.Wait()
+	}()
+	select {
+	case err = <-waitc:
+		return err
+	case <-time.After(sshSettleTime):
+	}
+	m.mu.Lock()
+	m.state = stateOn
+	m.since = time.Now()
+	m.mu.Unlock()
+	connected()
+	return <-waitc
+}
+
+// Close stops the tunnel and waits until it is down
+func (m *managedTunnel) Close() {
+	m.mu.Lock()
+	close(m.stop)
+	if m.cmd != nil {
+		m.cmd.Process.Kill()
+	}
+	if m.native != nil {
+		m.native.Close()
+	}
+	m.mu.Unlock()
+	<-m.done
+}
+
+func (m *managedTunnel) status() tunnelStatus {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return tunnelStatus{
+		Name:      m.conf.Name,
+		State:     m.state,
+		PID:       m.pid,
+		Since:     m.since,
+		LastError: m.lastErr,
+	}
+}
+
+// running tells if a tunnel is up or trying to be
+func (s tunnelStatus) running() bool {
+	return s.State == stateOn || s.State == stateConnecting
+}
+
+func (m *managedTunnel) configChanged(conf Config) bool {
+	return configHash(conf) != configHash(m.conf)
+}
+
+// supervisor owns every tunnel started through the daemon
+type supervisor struct {
+	dataPath   string
+	configPath string
+
+	mu      sync.Mutex
+	tunnels map[string]*managedTunnel
+}
+
+func newSupervisor(dataPath, configPath string) *supervisor {
+	return &supervisor{
+		dataPath:   dataPath,
+		configPath: configPath,
+		tunnels:    make(map[string]*managedTunnel),
+	}
+}
+
+func (s *supervisor) start(name string) error {
+	conf, err := loadConfig(s.configPath, name)
+	if err != nil {
+		return err
+	}
+	err = checkConfig(conf)
+	if err != nil {
+		return err
+	}
+	err = checkPortsError(s.configPath, conf)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if tunnel, ok := s.tunnels[name]; ok && !tunnel.finished() {
+		return fmt.Errorf("%s is already running", name)
+	}
+	if rec, err := readRecord(s.dataPath, name); err == nil && rec.alive() {
+		return fmt.Errorf("%s is already running outside of the daemon", name)
+	}
+	tunnel := newManagedTunnel(s.dataPath, conf)
+	s.tunnels[name] = tunnel
+	go tunnel.run()
+	return nil
+}
+
+func (s *supervisor) stop(name string) error {
+	s.mu.Lock()
+	tunnel, ok := s.tunnels[name]
+	delete(s.tunnels, name)
+	s.mu.Unlock()
+	if !ok {
+		// it may have been started before the daemon was
+		return stopProcess(s.dataPath, name)
+	}
+	tunnel.Close()
+	return nil
+}
+
+func (s *supervisor) restart(name string) error {
+	err := s.stop(name)
+	if err != nil {
+		return err
+	}
+	return s.start(name)
+}
+
+func (s *supervisor) stopAll() {
+	s.mu.Lock()
+	names := make([]string, 0, len(s.tunnels))
+	for name := range s.tunnels {
+		names = append(names, name)
+	}
+	s.mu.Unlock()
+	for _, name := range names {
+		s.stop(name)
+	}
+}
+
+// status reports every configured tunnel, or only the named one
+func (s *supervisor) status(name string) ([]tunnelStatus, error) {
+	names := []string{name}
+	if len(name) == 0 {
+		var err error
+		names, err = configNames(s.configPath)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	statuses := []tunnelStatus{}
+	for _, name := range names {
+		conf, err := loadConfig(s.configPath, name)
+		if err != nil {
+			status := unloadableStatus(s.dataPath, name, err)
+			if tunnel, ok := s.tunnels[name]; ok {
+				status = tunnel.status()
+				status.LastError = strings.TrimPrefix(err.Error(), name+": ")
+			}
+			statuses = append(statuses, status)
+			continue
+		}
+		if tunnel, ok := s.tunnels[name]; ok {
+			status := tunnel.status()
+			status.ConfigChanged = tunnel.configChanged(conf)
+			statuses = append(statuses, status)
+		} else {
+			statuses = append(statuses, recordStatus(s.dataPath, conf))
+		}
+	}
+	return statuses, nil
+}
+
+func (s *supervisor) handle(req request) response {
+	var err error
+	switch req.Command {
+	case "start":
+		err = s.start(req.Name)
+	case "stop":
+		err = s.stop(req.Name)
+	case "restart":
+		err = s.restart(req.Name)
+	case "status":
+	default:
+		err = fmt.Errorf("unknown command %q", req.Command)
+	}
+	if err != nil {
+		return response{Error: err.Error()}
+	}
+
+	statuses, err := s.status(req.Name)
+	if err != nil {
+		return response{Error: err.Error()}
+	}
+	return response{Tunnels: statuses}
+}
+
+func (s *supervisor) serve(ln net.Listener) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			var req request
+			err := json.NewDecoder(conn).Decode(&req)
+			if err != nil {
+				return
+			}
+			json.NewEncoder(conn).Encode(s.handle(req))
+		}()
+	}
+}
+
+// runDaemon serves the control socket until the process is interrupted, and
+// the metrics of its tunnels over HTTP when -metrics is given
+func runDaemon(dataPath, configPath string, args []string) error {
+	flags := flag.NewFlagSet("daemon", flag.ContinueOnError)
+	metricsAddr := flags.String("metrics", "", "address to serve /metrics on, like 127.0.0.1:9273")
+	err := flags.Parse(args)
+	if err != nil {
+		return usageError("sshtunnel daemon [-metrics address]")
+	}
+
+	path := socketPath(dataPath)
+	if len(path) > maxSocketPath {
+		return fmt.Errorf("control socket path %s is longer than %d characters, set TMPDIR to a shorter folder", path, maxSocketPath)
+	}
+	if _, err := daemonRequest(dataPath, request{Command: "status"}); err == nil {
+		return errors.New("daemon is already running")
+	}
+	os.Remove(path)
+
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(path)
+
+	s := newSupervisor(dataPath, configPath)
+	go s.serve(ln)
+	if len(*metricsAddr) > 0 {
+		go func() {
+			err := s.serveMetrics(*metricsAddr)
+			fmt.Fprintf(os.Stderr, "metrics: %s\n", err.Error())
+		}()
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	<-signals
+	ln.Close()
+	s.stopAll()
+	return nil
+}
+
+// socketPath returns the path of the control socket of the daemon that
+// serves dataPath. It is kept in the temporary folder because a data folder
+// in the Alfred preferences is too long for a unix socket
+func socketPath(dataPath string) string {
+	sum := sha256.Sum256([]byte(dataPath))
+	return filepath.Join(os.TempDir(), fmt.Sprintf("sshtunnel-%d-%x.sock", os.Getuid(), sum[:4]))
+}
+
+// daemonRequest sends a request to a running daemon
+func daemonRequest(dataPath string, req request) (response, error) {
+	var resp response
+	conn, err := net.DialTimeout("unix", socketPath(dataPath), daemonDialTimeout)
+	if err != nil {
+		return resp, errDaemonNotRunning
+	}
+	defer conn.Close()
+
+	err = json.NewEncoder(conn).Encode(req)
+	if err != nil {
+		return resp, err
+	}
+	err = json.NewDecoder(bufio.NewReader(conn)).Decode(&resp)
+	if err != nil {
+		return resp, err
+	}
+	if len(resp.Error) > 0 {
+		return resp, errors.New(resp.Error)
+	}
+	return resp, nil
+}
+
+// sendCommand sends a start, stop, restart or status command to the
+// daemon, or runs it directly when the daemon is not running
+func sendCommand(dataPath, configPath, command, name string) ([]tunnelStatus, error) {
+	resp, err := daemonRequest(dataPath, request{Command: command, Name: name})
+	if err == errDaemonNotRunning {
+		resp.Tunnels, err = runDirect(dataPath, configPath, command, name)
+	}
+	return resp.Tunnels, err
+}
+
+// tunnelCommand is sendCommand that starts the tunnels a tunnel depends on
+// before it is started
+func tunnelCommand(dataPath, configPath, command, name string) ([]tunnelStatus, error) {
+	if command == "start" || command == "restart" {
+		err := startDependencies(dataPath, configPath, name)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return sendCommand(dataPath, configPath, command, name)
+}
+
+// runClient runs a command for a single tunnel, or status for every tunnel,
+// and prints the result
+func runClient(dataPath, configPath, command string, args []string) error {
+	// -cascade only applies to stop and -json only to status
+	flags := flag.NewFlagSet(command, flag.ContinueOnError)
+	cascade, asJSON := new(bool), new(bool)
+	usage := fmt.Sprintf("sshtunnel %s <name>", command)
+	switch command {
+	case "stop":
+		flags.BoolVar(cascade, "cascade", false, "stop the tunnels that depend on the stopped one too")
+		usage += " [-cascade]"
+	case "status":
+		flags.BoolVar(asJSON, "json", false, "print the state of the tunnels as JSON")
+		usage = "sshtunnel status [name] [-json]"
+	}
+	err := flags.Parse(args)
+	if err != nil {
+		return usageError(usage)
+	}
+	name := flags.Arg(0)
+	if flags.NArg() > 1 {
+		err = flags.Parse(flags.Args()[1:])
+		if err != nil || flags.NArg() > 0 {
+			return usageError(usage)
+		}
+	}
+	if command != "status" && len(name) == 0 {
+		return usageError(usage)
+	}
+
+	stopped := []tunnelStatus{}
+	if command == "stop" {
+		stopped, err = stopDependents(dataPath, configPath, name, *cascade)
+		if err != nil {
+			return err
+		}
+	}
+	statuses, err := tunnelCommand(dataPath, configPath, command, name)
+	if err != nil {
+		return err
+	}
+	if *asJSON {
+		err = printStatusesJSON(configPath, append(stopped, statuses...))
+	} else {
+		printStatuses(dataPath, configPath, append(stopped, statuses...))
+	}
+	if err != nil {
+		return err
+	}
+	if command == "status" && len(name) > 0 && len(statuses) == 1 && !statuses[0].running() {
+		return errNotRunning
+	}
+	return nil
+}
+
+// configNames lists the names of every config in the config folder
+func configNames(configPath string) ([]string, error) {
+	files, err := ioutil.ReadDir(configPath)
+	if err != nil {
+		return nil, err
+	}
+	names := []string{}
+	for _, file := range files {
+		if strings.HasSuffix(file.Name(), ".yml") {
+			names = append(names, strings.TrimSuffix(file.Name(), ".yml"))
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	dependencyTimeout  = 30 * time.Second
+	dependencyInterval = 500 * time.Millisecond
+)
+
+// checkDependencyCycle follows DependsOn from a config and fails if it
+// comes back to a config it already passed. Dependencies that don't exist
+// are left to validation.
+func checkDependencyCycle(configPath string, conf Config) error {
+	path := []string{conf.Name}
+	var visit func(conf Config) error
+	visit = func(conf Config) error {
+		for _, dep := range conf.DependsOn {
+			if contains(path, dep) {
+				return fmt.Errorf("dependency cycle %s", strings.Join(append(path, dep), " → "))
+			}
+			next, err := readConfig(configPath, dep)
+			if err != nil {
+				continue
+			}
+			path = append(path, dep)
+			err = visit(next)
+			if err != nil {
+				return err
+			}
+			path = path[:len(path)-1]
+		}
+		return nil
+	}
+	return visit(conf)
+}
+
+// dependencyOrder returns every config a config depends on, directly or
+// not, in the order they have to be started
+func dependencyOrder(configPath, name string) ([]string, error) {
+	order := []string{}
+	var visit func(name string) error
+	visit = func(name string) error {
+		conf, err := loadConfig(configPath, name)
+		if err != nil {
+			return err
+		}
+		for _, dep := range conf.DependsOn {
+			if contains(order, dep) {
+				continue
+			}
+			err = visit(dep)
+			if err != nil {
+				return err
+			}
+			order = append(order, dep)
+		}
+		return nil
+	}
+	return order, visit(name)
+}
+
+// dependents returns every config that depends on a config, directly or
+// not, in the order they have to be stopped
+func dependents(configPath, name string) ([]string, error) {
+	names, err := configNames(configPath)
+	if err != nil {
+		return nil, err
+	}
+	dependsOn := map[string][]string{}
+	for _, other := range names {
+		conf, err := readConfig(configPath, other)
+		if err != nil {
+			continue
+		}
+		dependsOn[other] = conf.DependsOn
+	}
+
+	order := []string{}
+	// a config is marked before its own dependents are visited, so a cycle
+	// among them, which loading rejects, can't recurse forever
+	visited := map[string]bool{name: true}
+	var visit func(name string)
+	visit = func(name string) {
+		for _, other := range names {
+			if contains(dependsOn[other], name) && !visited[other] {
+				visited[other] = true
+				visit(other)
+				order = append(order, other)
+			}
+		}
+	}
+	// the ones further away are added first, since they have to stop first
+	visit(name)
+	return order, nil
+}
+
+// startDependencies starts whatever a config depends on and waits until all
+// of it is healthy
+func startDependencies(dataPath, configPath, name string) error {
+	deps, err := dependencyOrder(configPath, name)
+	if err != nil || len(deps) == 0 {
+		return err
+	}
+	statuses, err := currentStatus(dataPath, configPath)
+	if err != nil {
+		return err
+	}
+	for _, dep := range deps {
+		if !statuses[dep].running() {
+			_, err := sendCommand(dataPath, configPath, "start", dep)
+			if err != nil {
+				return fmt.Errorf("%s depends on %s: %s", name, dep, err.Error())
+			}
+		}
+		conf, err := loadConfig(configPath, dep)
+		if err != nil {
+			return err
+		}
+		err = waitHealthy(conf, dependencyTimeout)
+		if err != nil {
+			return fmt.Errorf("%s depends on %s: %s", name, dep, err.Error())
+		}
+	}
+	return nil
+}
+
+// waitHealthy waits until every forward of a tunnel answers
+func waitHealthy(conf Config, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		h := checkHealth(conf)
+		if h.State == healthHealthy {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("still %s after %s", h, timeout)
+		}
+		time.Sleep(dependencyInterval)
+	}
+}
+
+// stopDependents stops the running tunnels that depend on a tunnel when
+// cascade is set and returns their state, and warns about them otherwise
+func stopDependents(dataPath, configPath, name string, cascade bool) ([]tunnelStatus, error) {
+	stopped := []tunnelStatus{}
+	names, err := dependents(configPath, name)
+	if err != nil || len(names) == 0 {
+		return stopped, err
+	}
+	statuses, err := currentStatus(dataPath, configPath)
+	if err != nil {
+		return stopped, err
+	}
+	running := []string{}
+	for _, other := range names {
+		if statuses[other].running() {
+			running = append(running, other)
+		}
+	}
+	if len(running) == 0 {
+		return stopped, nil
+	}
+	if !cascade {
+		fmt.Fprintf(os.Stderr, "warning: %s still depend on %s, use -cascade to stop them too\n", strings.Join(running, ", "), name)
+		return stopped, nil
+	}
+	for _, other := range running {
+		result, err := sendCommand(dataPath, configPath, "stop", other)
+		if err != nil {
+			return stopped, err
+		}
+		stopped = append(stopped, result...)
+	}
+	return stopped, nil
+}
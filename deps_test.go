@@ -0,0 +1,93 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// writeConfigs writes configs that only differ in what they depend on and
+// returns their folder
+func writeConfigs(t *testing.T, dependsOn map[string][]string) string {
+	t.Helper()
+	configPath := t.TempDir()
+	for name, deps := range dependsOn {
+		body := "RemoteUser: user\nRemoteHost: example.com\nLocalBindAddress: 127.0.0.1\n"
+		if len(deps) > 0 {
+			body += "DependsOn: [" + strings.Join(deps, ", ") + "]\n"
+		}
+		err := ioutil.WriteFile(filepath.Join(configPath, name+".yml"), []byte(body), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return configPath
+}
+
+func TestDependents(t *testing.T) {
+	configPath := writeConfigs(t, map[string][]string{
+		"db":   nil,
+		"app":  {"db"},
+		"web":  {"app"},
+		"self": {"db", "self"},
+		"a":    {"db", "b"},
+		"b":    {"a"},
+	})
+	got, err := dependents(configPath, "db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// every dependent comes after the ones that depend on it, and the cycle
+	// between a and b is only followed once
+	want := []string{"b", "a", "web", "app", "self"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("dependents(db) = %v, want %v", got, want)
+	}
+
+	got, err = dependents(configPath, "self")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 0 {
+		t.Errorf("dependents(self) = %v, want none", got)
+	}
+}
+
+func TestDependencyCycle(t *testing.T) {
+	configPath := writeConfigs(t, map[string][]string{
+		"db":   nil,
+		"app":  {"db"},
+		"self": {"db", "self"},
+		"a":    {"b"},
+		"b":    {"a"},
+	})
+	tests := []struct {
+		name  string
+		cycle string
+	}{
+		{"db", ""},
+		{"app", ""},
+		{"self", "self → self"},
+		{"a", "a → b → a"},
+		{"b", "b → a → b"},
+	}
+	for _, test := range tests {
+		_, err := loadConfig(configPath, test.name)
+		switch {
+		case len(test.cycle) == 0 && err != nil:
+			t.Errorf("loadConfig(%s) failed: %v", test.name, err)
+		case len(test.cycle) > 0 && (err == nil || !strings.Contains(err.Error(), test.cycle)):
+			t.Errorf("loadConfig(%s) = %v, want dependency cycle %s", test.name, err, test.cycle)
+		}
+	}
+
+	order, err := dependencyOrder(configPath, "app")
+	if err != nil || !reflect.DeepEqual(order, []string{"db"}) {
+		t.Errorf("dependencyOrder(app) = %v, %v, want [db]", order, err)
+	}
+	if _, err := dependencyOrder(configPath, "a"); err == nil {
+		t.Error("dependencyOrder(a) didn't fail on the cycle")
+	}
+}
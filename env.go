@@ -0,0 +1,134 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+)
+
+// expandConfig replaces ${VAR} and ${VAR:-default} in every string of a
+// config with the environment, and a leading ~ in its identity files with
+// the home directory
+func expandConfig(conf *Config) error {
+	err := expandValue(reflect.ValueOf(conf).Elem(), "")
+	if err != nil {
+		return err
+	}
+	conf.IdentityFile = expandHome(conf.IdentityFile)
+	for i := range conf.JumpHosts {
+		conf.JumpHosts[i].IdentityFile = expandHome(conf.JumpHosts[i].IdentityFile)
+	}
+	return nil
+}
+
+var forwardType = reflect.TypeOf(forward{})
+
+// expandValue expands every string reachable from v, path is the field
+// reported when a variable is not set
+func expandValue(v reflect.Value, path string) error {
+	switch v.Kind() {
+	case reflect.String:
+		value, err := expandEnv(v.String())
+		if err != nil {
+			return fmt.Errorf("%s: %s", path, err.Error())
+		}
+		v.SetString(value)
+	case reflect.Slice:
+		for i := 0; i < v.Len(); i++ {
+			err := expandValue(v.Index(i), fmt.Sprintf("%s[%d]", path, i))
+			if err != nil {
+				return err
+			}
+		}
+	case reflect.Struct:
+		// a forward written as a string is expanded as a whole, since a
+		// default can hold the colons it is split on
+		if v.Type() == forwardType {
+			if fw := v.Addr().Interface().(*forward); len(fw.spec) > 0 {
+				spec, err := expandEnv(fw.spec)
+				if err != nil {
+					return fmt.Errorf("%s: %s", path, err.Error())
+				}
+				*fw = parseForward(spec)
+				return nil
+			}
+		}
+		t := v.Type()
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			if len(field.PkgPath) > 0 && !field.Anonymous || field.Tag.Get("yaml") == "-" {
+				continue
+			}
+			fieldPath := path
+			if !field.Anonymous {
+				fieldPath = strings.TrimPrefix(path+"."+field.Name, ".")
+			}
+			err := expandValue(v.Field(i), fieldPath)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// expandEnv replaces ${VAR} with the variable, which has to be set, and
+// ${VAR:-default} with the variable or default when it is unset or empty.
+// $$ is a literal $.
+func expandEnv(value string) (string, error) {
+	var out strings.Builder
+	for {
+		i := strings.IndexByte(value, '$')
+		if i < 0 || i == len(value)-1 {
+			out.WriteString(value)
+			return out.String(), nil
+		}
+		out.WriteString(value[:i])
+		value = value[i+1:]
+		switch value[0] {
+		case '$':
+			out.WriteByte('$')
+			value = value[1:]
+			continue
+		case '{':
+		default:
+			out.WriteByte('$')
+			continue
+		}
+
+		end := strings.IndexByte(value, '}')
+		if end < 0 {
+			return "", fmt.Errorf("missing } after ${%s", value[1:])
+		}
+		name, def := value[1:end], ""
+		hasDefault := false
+		if j := strings.Index(name, ":-"); j >= 0 {
+			name, def, hasDefault = name[:j], name[j+2:], true
+		}
+		if !validEnvName(name) {
+			return "", fmt.Errorf("${%s} is not a valid variable", value[1:end])
+		}
+		env, ok := os.LookupEnv(name)
+		switch {
+		case hasDefault && len(env) == 0:
+			env = def
+		case !ok:
+			return "", fmt.Errorf("environment variable %s is not set and ${%s} has no default", name, name)
+		}
+		out.WriteString(env)
+		value = value[end+1:]
+	}
+}
+
+func validEnvName(name string) bool {
+	if len(name) == 0 || name[0] >= '0' && name[0] <= '9' {
+		return false
+	}
+	for _, r := range name {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '_') {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// forward is a single local port forward. It can be written as a mapping
+// or, like before, as a string that follows LocalBindAddress in ssh -L.
+type forward struct {
+	LocalPort   string `yaml:"LocalPort"`
+	RemoteHost  string `yaml:"RemoteHost"`
+	RemotePort  string `yaml:"RemotePort"`
+	Label       string `yaml:"Label,omitempty"`
+	BindAddress string `yaml:"BindAddress,omitempty"`
+	// Probe is how the health of the forward is checked: tcp, http or
+	// postgres, ProbePath is the path requested by an http probe
+	Probe     string `yaml:"Probe,omitempty"`
+	ProbePath string `yaml:"ProbePath,omitempty"`
+
+	// spec is the string the forward was read from, if it was one
+	spec string
+}
+
+// UnmarshalYAML reads either form of a forward. A string that can't be
+// parsed is kept as it is so validation can report it.
+func (f *forward) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var spec string
+	if err := unmarshal(&spec); err == nil {
+		*f = parseForward(spec)
+		return nil
+	}
+	type plain forward
+	return unmarshal((*plain)(f))
+}
+
+// MarshalYAML writes a forward that was read from a string that couldn't be
+// parsed as that string, so it is not lost
+func (f forward) MarshalYAML() (interface{}, error) {
+	if len(f.spec) > 0 && len(f.LocalPort) == 0 {
+		return f.spec, nil
+	}
+	type plain forward
+	return plain(f), nil
+}
+
+// parseForward parses the string form of a forward: port:host:hostport, with
+// the leading colon it used to need, or with a bind address of its own
+func parseForward(spec string) forward {
+	fw := forward{spec: spec}
+	fields := strings.Split(spec, ":")
+	switch len(fields) {
+	case 3:
+		fw.LocalPort, fw.RemoteHost, fw.RemotePort = fields[0], fields[1], fields[2]
+	case 4:
+		fw.BindAddress, fw.LocalPort, fw.RemoteHost, fw.RemotePort = fields[0], fields[1], fields[2], fields[3]
+	}
+	return fw
+}
+
+func (f forward) local() string {
+	return net.JoinHostPort(f.BindAddress, f.LocalPort)
+}
+
+func (f forward) remote() string {
+	return net.JoinHostPort(f.RemoteHost, f.RemotePort)
+}
+
+// String returns the forward as ssh -L takes it
+func (f forward) String() string {
+	return f.local() + ":" + f.remote()
+}
+
+// validate returns why a forward can't be used, or nil
+func (f forward) validate() error {
+	if len(f.LocalPort) == 0 && len(f.spec) > 0 {
+		return fmt.Errorf("invalid forward %q", f.spec)
+	}
+	if !validPort(f.LocalPort) {
+		return fmt.Errorf("invalid local port %q", f.LocalPort)
+	}
+	if !validHost(f.RemoteHost) {
+		return fmt.Errorf("invalid remote host %q", f.RemoteHost)
+	}
+	if !validPort(f.RemotePort) {
+		return fmt.Errorf("invalid remote port %q", f.RemotePort)
+	}
+	if len(f.BindAddress) > 0 && net.ParseIP(f.BindAddress) == nil {
+		return fmt.Errorf("invalid bind address %q", f.BindAddress)
+	}
+	if len(f.Probe) > 0 && !contains(probeTypes, f.Probe) {
+		return fmt.Errorf("probe %q is not one of %s", f.Probe, strings.Join(probeTypes, ", "))
+	}
+	return nil
+}
+
+// forwards returns the local forwards with their bind address resolved
+func (c Config) forwards() []forward {
+	forwards := []forward{}
+	for _, fw := range c.ForwardPorts {
+		if len(fw.BindAddress) == 0 {
+			fw.BindAddress = c.LocalBindAddress
+		}
+		forwards = append(forwards, fw)
+	}
+	return forwards
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+const groupFolder = "groups"
+
+// group is a set of tunnels that are started and stopped together. Its
+// members are the ones listed in groups/<name>.yml and the configs that name
+// it in their Groups.
+type group struct {
+	Members []string `yaml:"Members"`
+
+	Name string `yaml:"-"`
+}
+
+// loadGroups returns every group, sorted by name
+func loadGroups(dataPath, configPath string) ([]group, error) {
+	members := map[string][]string{}
+	add := func(name, member string) {
+		if !contains(members[name], member) {
+			members[name] = append(members[name], member)
+		}
+	}
+
+	files, err := ioutil.ReadDir(dataPath + "/" + groupFolder)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	for _, file := range files {
+		if !strings.HasSuffix(file.Name(), ".yml") {
+			continue
+		}
+		name := strings.TrimSuffix(file.Name(), ".yml")
+		bt, err := ioutil.ReadFile(dataPath + "/" + groupFolder + "/" + file.Name())
+		if err != nil {
+			return nil, err
+		}
+		var g group
+		err = yaml.Unmarshal(bt, &g)
+		if err != nil {
+			return nil, fmt.Errorf("group %s: %s", name, err.Error())
+		}
+		members[name] = nil
+		for _, member := range g.Members {
+			add(name, member)
+		}
+	}
+
+	names, err := configNames(configPath)
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range names {
+		conf, err := loadConfig(configPath, name)
+		if err != nil {
+			continue
+		}
+		for _, g := range conf.Groups {
+			add(g, name)
+		}
+	}
+
+	groups := []group{}
+	for name, list := range members {
+		groups = append(groups, group{Name: name, Members: list})
+	}
+	sort.Slice(groups, func(i, j int) bool {
+		return groups[i].Name < groups[j].Name
+	})
+	return groups, nil
+}
+
+func findGroup(dataPath, configPath, name string) (group, error) {
+	groups, err := loadGroups(dataPath, configPath)
+	if err != nil {
+		return group{}, err
+	}
+	for _, g := range groups {
+		if g.Name == name {
+			return g, nil
+		}
+	}
+	return group{}, fmt.Errorf("group %s does not exist", name)
+}
+
+// countRunning returns how many members of a group are running
+func (g group) countRunning(statuses map[string]tunnelStatus) int {
+	count := 0
+	for _, member := range g.Members {
+		if statuses[member].running() {
+			count++
+		}
+	}
+	return count
+}
+
+// runGroup runs a command for every member of a group. start only starts
+// the members that are not running and stop only stops the ones that are,
+// restart restarts the running ones and starts the others. A member that
+// fails doesn't keep the others from being handled.
+func runGroup(dataPath, configPath string, args []string) error {
+	if len(args) != 2 {
+		return usageError("sshtunnel group start|stop|restart|status <group>")
+	}
+	command, name := args[0], args[1]
+	switch command {
+	case "start", "stop", "restart", "status":
+	default:
+		return usageError("sshtunnel group start|stop|restart|status <group>")
+	}
+	g, err := findGroup(dataPath, configPath, name)
+	if err != nil {
+		return err
+	}
+	current, err := currentStatus(dataPath, configPath)
+	if err != nil {
+		return err
+	}
+
+	failed := 0
+	statuses := []tunnelStatus{}
+	for _, member := range g.Members {
+		memberCommand := command
+		switch {
+		case command == "start" && current[member].running(),
+			command == "stop" && !current[member].running():
+			memberCommand = "status"
+		case command == "restart" && !current[member].running():
+			memberCommand = "start"
+		}
+		result, err := tunnelCommand(dataPath, configPath, memberCommand, member)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", member, err.Error())
+			failed++
+			continue
+		}
+		statuses = append(statuses, result...)
+	}
+	printStatuses(dataPath, configPath, statuses)
+	if failed > 0 {
+		return fmt.Errorf("%d of %d members of %s failed", failed, len(g.Members), name)
+	}
+	return nil
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	healthHealthy  = "healthy"
+	healthDegraded = "degraded"
+	healthDown     = "down"
+)
+
+const (
+	probeTCP      = "tcp"
+	probeHTTP     = "http"
+	probePostgres = "postgres"
+)
+
+// healthIcons are shown instead of On.png for a tunnel that is not healthy
+var healthIcons = map[string]string{
+	healthDegraded: "Degraded.png",
+	healthDown:     "Down.png",
+}
+
+var probeTypes = []string{probeTCP, probeHTTP, probePostgres}
+
+const probeTimeout = time.Second
+
+// postgresSSLRequest is the SSLRequest startup message, which every
+// postgres server answers with a single S or N before authentication
+var postgresSSLRequest = []byte{0, 0, 0, 8, 0x04, 0xd2, 0x16, 0x2f}
+
+// health is the result of probing every local endpoint of a running tunnel
+type health struct {
+	State    string
+	Failures []string
+}
+
+// checkHealth probes every local endpoint of a tunnel. It is healthy when
+// all of them answer, down when none does and degraded otherwise.
+func checkHealth(conf Config) health {
+	type target struct {
+		endpoint string
+		probe    func() error
+	}
+	targets := []target{}
+	for _, fw := range conf.forwards() {
+		fw := fw
+		targets = append(targets, target{fw.local(), func() error { return probeForward(fw) }})
+	}
+	for _, port := range conf.DynamicForwards {
+		endpoint := net.JoinHostPort(conf.LocalBindAddress, port)
+		targets = append(targets, target{endpoint, func() error { return probeTCPConnect(endpoint) }})
+	}
+
+	errs := make([]error, len(targets))
+	var wg sync.WaitGroup
+	for i, t := range targets {
+		wg.Add(1)
+		go func(i int, probe func() error) {
+			defer wg.Done()
+			errs[i] = probe()
+		}(i, t.probe)
+	}
+	wg.Wait()
+
+	h := health{State: healthHealthy}
+	for i, err := range errs {
+		if err != nil {
+			h.Failures = append(h.Failures, targets[i].endpoint+" "+err.Error())
+		}
+	}
+	switch {
+	case len(h.Failures) == 0:
+	case len(h.Failures) == len(targets):
+		h.State = healthDown
+	default:
+		h.State = healthDegraded
+	}
+	return h
+}
+
+// healthBudget bounds how long checkHealthAll waits for every tunnel
+const healthBudget = 2 * probeTimeout
+
+// checkHealthAll probes every tunnel at once, so a list doesn't wait for
+// one tunnel after another. A tunnel that hasn't answered within
+// healthBudget is down.
+func checkHealthAll(confs []Config) map[string]health {
+	type result struct {
+		name string
+		h    health
+	}
+	results := make(chan result, len(confs))
+	for _, conf := range confs {
+		go func(conf Config) {
+			results <- result{conf.Name, checkHealth(conf)}
+		}(conf)
+	}
+
+	healths := map[string]health{}
+	timeout := time.After(healthBudget)
+wait:
+	for range confs {
+		select {
+		case r := <-results:
+			healths[r.name] = r.h
+		case <-timeout:
+			break wait
+		}
+	}
+	for _, conf := range confs {
+		if _, ok := healths[conf.Name]; !ok {
+			healths[conf.Name] = health{State: healthDown, Failures: []string{"no answer within " + healthBudget.String()}}
+		}
+	}
+	return healths
+}
+
+// String describes an unhealthy tunnel for an item subtitle
+func (h health) String() string {
+	if len(h.Failures) == 0 {
+		return h.State
+	}
+	return h.State + ": " + strings.Join(h.Failures, ", ")
+}
+
+// probeForward checks that a forward accepts connections and, when it has a
+// Probe, that the service behind it answers
+func probeForward(fw forward) error {
+	switch fw.Probe {
+	case probeHTTP:
+		return probeHTTPStatus(fw.local(), fw.ProbePath)
+	case probePostgres:
+		return probePostgresStartup(fw.local())
+	}
+	return probeTCPConnect(fw.local())
+}
+
+func probeTCPConnect(endpoint string) error {
+	conn, err := net.DialTimeout("tcp", endpoint, probeTimeout)
+	if err != nil {
+		return probeError(err)
+	}
+	return conn.Close()
+}
+
+// probeHTTPStatus fails on anything but a response below 500, since a 404
+// or 401 still means the service is up
+func probeHTTPStatus(endpoint, path string) error {
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+	client := http.Client{Timeout: probeTimeout}
+	resp, err := client.Get("http://" + endpoint + path)
+	if err != nil {
+		return probeError(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 500 {
+		return fmt.Errorf("HTTP %d", resp.StatusCode)
+	}
+	return nil
+}
+
+func probePostgresStartup(endpoint string) error {
+	conn, err := net.DialTimeout("tcp", endpoint, probeTimeout)
+	if err != nil {
+		return probeError(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(probeTimeout))
+
+	_, err = conn.Write(postgresSSLRequest)
+	if err != nil {
+		return probeError(err)
+	}
+	reply := make([]byte, 1)
+	_, err = io.ReadFull(conn, reply)
+	if err != nil {
+		return probeError(err)
+	}
+	if reply[0] != 'S' && reply[0] != 'N' {
+		return fmt.Errorf("not postgres (got %q)", reply[0])
+	}
+	return nil
+}
+
+// probeError shortens an error to what is useful in a subtitle
+func probeError(err error) error {
+	if err, ok := err.(net.Error); ok && err.Timeout() {
+		return fmt.Errorf("timed out")
+	}
+	if err == io.EOF {
+		return fmt.Errorf("closed by remote")
+	}
+	msg := err.Error()
+	if i := strings.LastIndex(msg, ": "); i >= 0 {
+		msg = msg[i+2:]
+	}
+	return fmt.Errorf("%s", msg)
+}
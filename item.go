@@ -0,0 +1,66 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/seungbemi/gofred"
+)
+
+// item is a gofred item with what the list needs and gofred doesn't have:
+// the text a query is matched against besides the title, and an action for
+// the shift key
+type item struct {
+	gofred.Item
+	Match string    `json:"match,omitempty"`
+	Mods  modifiers `json:"mods"`
+}
+
+type modifiers struct {
+	gofred.Modifiers
+	ShiftKey gofred.SubInfo `json:"shift,omitempty"`
+}
+
+func newItem(it gofred.Item) item {
+	return item{Item: it}
+}
+
+// addMatch sets the text an item is matched against besides its title
+func (i item) addMatch(match string) item {
+	i.Match = match
+	return i
+}
+
+// addShiftKeyAction adds what is shown and run when the shift key is held
+func (i item) addShiftKeyAction(subtitle, arg string, executable bool, vars ...gofred.Variable) item {
+	// gofred only knows cmd, alt and ctrl, so the action is built as a ctrl
+	// one and moved
+	action := gofred.Item{}.AddCtrlKeyAction(subtitle, arg, executable).AddCtrlKeyVariables(vars...)
+	i.Mods.ShiftKey = action.Mods.CtrlKey
+	return i
+}
+
+// MarshalJSON writes the item with gofred's modifiers and the shift key
+// together under mods
+func (i item) MarshalJSON() ([]byte, error) {
+	type plain item
+	i.Mods.Modifiers = i.Item.Mods
+	return json.Marshal(plain(i))
+}
+
+// itemResponse is a gofred.Response of items
+type itemResponse struct {
+	Items []item `json:"items"`
+}
+
+func (r *itemResponse) addItems(items ...item) {
+	r.Items = append(r.Items, items...)
+}
+
+func (r *itemResponse) String() string {
+	bt, err := json.Marshal(r)
+	if err != nil {
+		fmt.Println(err.Error())
+	}
+	return string(bt)
+}
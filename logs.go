@@ -0,0 +1,223 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	logFolder = "logs"
+	// a log is rotated to <name>.log.1 once it is this big, and the oldest
+	// of maxLogFiles is removed
+	maxLogSize     = 1 << 20
+	maxLogFiles    = 3
+	logTimeFormat  = "2006-01-02 15:04:05"
+	followInterval = 500 * time.Millisecond
+)
+
+func logPath(dataPath, name string) string {
+	return dataPath + "/" + logFolder + "/" + name + ".log"
+}
+
+// tunnelLog is where the output of a tunnel and what its supervisor does
+// with it goes. Every line starts with the time it was written.
+type tunnelLog struct {
+	path string
+
+	mu      sync.Mutex
+	file    *os.File
+	size    int64
+	midLine bool
+}
+
+func openLog(dataPath, name string) (*tunnelLog, error) {
+	err := os.MkdirAll(dataPath+"/"+logFolder, os.ModePerm)
+	if err != nil {
+		return nil, err
+	}
+	l := &tunnelLog{path: logPath(dataPath, name)}
+	return l, l.open()
+}
+
+func (l *tunnelLog) open() error {
+	file, err := os.OpenFile(l.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	l.file = file
+	l.size = info.Size()
+	return nil
+}
+
+// rotate moves name.log to name.log.1, name.log.1 to name.log.2 and so on,
+// and starts a new name.log
+func (l *tunnelLog) rotate() error {
+	l.file.Close()
+	for i := maxLogFiles - 1; i > 0; i-- {
+		from := l.path
+		if i > 1 {
+			from = fmt.Sprintf("%s.%d", l.path, i-1)
+		}
+		os.Rename(from, fmt.Sprintf("%s.%d", l.path, i))
+	}
+	return l.open()
+}
+
+// Write writes output as it is, only starting each line with the time
+func (l *tunnelLog) Write(p []byte) (int, error) {
+	if l == nil {
+		return len(p), nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	written := 0
+	for len(p) > 0 {
+		line := p
+		if i := bytes.IndexByte(p, '\n'); i >= 0 {
+			line = p[:i+1]
+		}
+		if !l.midLine {
+			if l.size >= maxLogSize {
+				err := l.rotate()
+				if err != nil {
+					return written, err
+				}
+			}
+			n, err := fmt.Fprintf(l.file, "%s ", time.Now().Format(logTimeFormat))
+			l.size += int64(n)
+			if err != nil {
+				return written, err
+			}
+		}
+		n, err := l.file.Write(line)
+		l.size += int64(n)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		l.midLine = line[len(line)-1] != '\n'
+		p = p[len(line):]
+	}
+	return written, nil
+}
+
+// Printf writes a line of its own
+func (l *tunnelLog) Printf(format string, args ...interface{}) {
+	if l == nil {
+		return
+	}
+	msg := fmt.Sprintf(format, args...)
+	l.mu.Lock()
+	midLine := l.midLine
+	l.mu.Unlock()
+	if midLine {
+		msg = "\n" + msg
+	}
+	l.Write([]byte(msg + "\n"))
+}
+
+func (l *tunnelLog) Close() error {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.file.Close()
+}
+
+// runLogs prints the last lines of a tunnel's log, and with -follow keeps
+// printing what is written to it
+func runLogs(dataPath string, args []string) error {
+	flags := flag.NewFlagSet("logs", flag.ContinueOnError)
+	lines := flags.Int("n", 100, "number of lines to print, 0 for all")
+	follow := flags.Bool("follow", false, "keep printing new lines")
+	flags.BoolVar(follow, "f", false, "shorthand for -follow")
+	err := flags.Parse(args)
+	if err != nil || flags.NArg() == 0 {
+		return usageError("sshtunnel logs <name> [-n lines] [-follow]")
+	}
+	// the flags may come after the name too
+	name := flags.Arg(0)
+	err = flags.Parse(flags.Args()[1:])
+	if err != nil || flags.NArg() > 0 {
+		return usageError("sshtunnel logs <name> [-n lines] [-follow]")
+	}
+
+	path := logPath(dataPath, name)
+	file, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return fmt.Errorf("%s has no log yet", name)
+		}
+		return err
+	}
+	defer func() {
+		file.Close()
+	}()
+	bt, err := ioutil.ReadAll(file)
+	if err != nil {
+		return err
+	}
+	os.Stdout.Write(lastLines(bt, *lines))
+	if !*follow {
+		return nil
+	}
+
+	for {
+		time.Sleep(followInterval)
+		_, err := io.Copy(os.Stdout, file)
+		if err != nil {
+			return err
+		}
+
+		// once the log is rotated, print what is left of the old file and go
+		// on with the new one
+		current, err := os.Stat(path)
+		if err != nil {
+			continue
+		}
+		opened, err := file.Stat()
+		if err != nil || os.SameFile(current, opened) {
+			continue
+		}
+		next, err := os.Open(path)
+		if err != nil {
+			continue
+		}
+		io.Copy(os.Stdout, file)
+		file.Close()
+		file = next
+	}
+}
+
+// lastLines returns the last n lines of a text, or all of it if n is 0
+func lastLines(bt []byte, n int) []byte {
+	if n <= 0 {
+		return bt
+	}
+	end := len(bt)
+	if end > 0 && bt[end-1] == '\n' {
+		end--
+	}
+	for i := end - 1; i >= 0; i-- {
+		if bt[i] == '\n' {
+			n--
+			if n == 0 {
+				return bt[i+1:]
+			}
+		}
+	}
+	return bt
+}
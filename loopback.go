@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os/exec"
+	"strings"
+)
+
+// loopbackAddresses returns every address of the loopback interfaces
+func loopbackAddresses() ([]string, error) {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+	addresses := []string{}
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagLoopback == 0 {
+			continue
+		}
+		addrs, err := iface.Addrs()
+		if err != nil {
+			return nil, err
+		}
+		for _, addr := range addrs {
+			if ipnet, ok := addr.(*net.IPNet); ok {
+				addresses = append(addresses, ipnet.IP.String())
+			}
+		}
+	}
+	return addresses, nil
+}
+
+// needsAlias tells if the bind address of a config has to be added to the
+// loopback interface before the tunnel can start. An address that isn't one
+// is a problem of the config instead.
+func needsAlias(conf Config, problems []problem, loopback []string) bool {
+	return !hasProblem(problems, "LocalBindAddress") && !loopbackReady(conf.LocalBindAddress, loopback)
+}
+
+// runAlias adds the bind address of every config that needs it to the
+// loopback interface
+func runAlias(configPath string) error {
+	names, err := configNames(configPath)
+	if err != nil {
+		return err
+	}
+	loopback, err := loopbackAddresses()
+	if err != nil {
+		return err
+	}
+	addresses := []string{}
+	for _, name := range names {
+		conf, err := loadConfig(configPath, name)
+		if err != nil {
+			continue
+		}
+		if needsAlias(conf, validate(conf), loopback) && !contains(addresses, conf.LocalBindAddress) {
+			addresses = append(addresses, conf.LocalBindAddress)
+		}
+	}
+	if len(addresses) == 0 {
+		return nil
+	}
+	for _, argv := range aliasCommands(addresses) {
+		out, err := exec.Command(argv[0], argv[1:]...).CombinedOutput()
+		if err != nil {
+			reason := strings.TrimSpace(string(out))
+			if len(reason) == 0 {
+				reason = err.Error()
+			}
+			return fmt.Errorf("%s: %s", argv[0], reason)
+		}
+	}
+	return nil
+}
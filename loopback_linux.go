@@ -0,0 +1,22 @@
+package main
+
+import "net"
+
+// loopbackReady tells if a tunnel can bind to an address. Linux routes all
+// of 127.0.0.0/8 to lo, so only other addresses have to be added.
+func loopbackReady(address string, addresses []string) bool {
+	if ip := net.ParseIP(address); ip != nil && ip.IsLoopback() {
+		return true
+	}
+	return contains(addresses, address)
+}
+
+// aliasCommands returns the commands that add every address to lo through
+// pkexec
+func aliasCommands(addresses []string) [][]string {
+	commands := [][]string{}
+	for _, address := range addresses {
+		commands = append(commands, []string{"pkexec", "ip", "addr", "add", address, "dev", "lo"})
+	}
+	return commands
+}
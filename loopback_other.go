@@ -0,0 +1,29 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import "strings"
+
+// loopbackReady tells if a tunnel can bind to an address. macOS only
+// answers on 127.0.0.1 until other addresses are aliased to lo0.
+func loopbackReady(address string, addresses []string) bool {
+	return contains(addresses, address)
+}
+
+// aliasCommands returns the commands that alias every address to lo0 with
+// administrator privileges. osascript asks for the password once and runs
+// the ifconfig commands with a shell.
+func aliasCommands(addresses []string) [][]string {
+	commands := []string{}
+	for _, address := range addresses {
+		commands = append(commands, shellJoin("ifconfig", "lo0", "alias", address))
+	}
+	script := "do shell script " + appleScriptQuote(strings.Join(commands, " && ")) + " with administrator privileges"
+	return [][]string{{"osascript", "-e", script}}
+}
+
+// appleScriptQuote quotes a string literal for AppleScript
+func appleScriptQuote(str string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(str) + `"`
+}
@@ -3,10 +3,9 @@ package main
 import (
 	"flag"
 	"fmt"
-	"io/ioutil"
+	"net"
 	"os"
-	"os/exec"
-	"strconv"
+	"os/user"
 	"strings"
 
 	"github.com/seungbemi/gofred"
@@ -20,21 +19,110 @@ const (
 )
 
 type host struct {
-	RemoteUser   string   `yaml:"RemoteUser"`
-	RemoteHost   string   `yaml:"RemoteHost"`
-	RemotePort   string   `yaml:"RemotePort"`
-	ForwardPorts []string `yaml:"ForwardPorts"`
+	RemoteUser      string          `yaml:"RemoteUser"`
+	RemoteHost      string          `yaml:"RemoteHost"`
+	RemotePort      string          `yaml:"RemotePort,omitempty"`
+	ForwardPorts    []forward       `yaml:"ForwardPorts,omitempty"`
+	RemoteForwards  []remoteForward `yaml:"RemoteForwards,omitempty"`
+	DynamicForwards []string        `yaml:"DynamicForwards,omitempty"`
+	JumpHosts       []jumpHost      `yaml:"JumpHosts,omitempty"`
+}
+
+// jumpHost is a hop on the way to RemoteHost, in the order they are dialed
+type jumpHost struct {
+	User         string `yaml:"User,omitempty"`
+	Host         string `yaml:"Host"`
+	Port         string `yaml:"Port,omitempty"`
+	IdentityFile string `yaml:"IdentityFile,omitempty"`
+}
+
+// user returns the hop's user, which defaults to the local user like it
+// does for ssh
+func (j jumpHost) user() string {
+	if len(j.User) == 0 {
+		return localUser()
+	}
+	return j.User
+}
+
+func localUser() string {
+	current, err := user.Current()
+	if err != nil {
+		return os.Getenv("USER")
+	}
+	return current.Username
+}
+
+func (j jumpHost) address() string {
+	port := j.Port
+	if len(port) == 0 {
+		port = defaultSSHPort
+	}
+	return net.JoinHostPort(j.Host, port)
+}
+
+// String returns the hop as ssh -J takes it
+func (j jumpHost) String() string {
+	dest := j.Host
+	if len(j.User) > 0 {
+		dest = j.User + "@" + dest
+	}
+	if len(j.Port) > 0 {
+		dest += ":" + j.Port
+	}
+	return dest
+}
+
+// remoteForward exposes a local target on the remote host
+type remoteForward struct {
+	RemoteBindAddress string `yaml:"RemoteBindAddress,omitempty"`
+	RemotePort        string `yaml:"RemotePort,omitempty"`
+	LocalHost         string `yaml:"LocalHost,omitempty"`
+	LocalPort         string `yaml:"LocalPort"`
+}
+
+func (f remoteForward) remote() string {
+	return net.JoinHostPort(f.RemoteBindAddress, f.RemotePort)
+}
+
+func (f remoteForward) local() string {
+	return net.JoinHostPort(f.localHost(), f.LocalPort)
+}
+
+func (f remoteForward) localHost() string {
+	if len(f.LocalHost) == 0 {
+		return "localhost"
+	}
+	return f.LocalHost
+}
+
+// String returns the forward as ssh -R takes it
+func (f remoteForward) String() string {
+	spec := f.RemotePort + ":" + f.localHost() + ":" + f.LocalPort
+	if len(f.RemoteBindAddress) > 0 {
+		spec = f.RemoteBindAddress + ":" + spec
+	}
+	return spec
 }
 
 // Config includes
 type Config struct {
+	// Version is the schema the config is written in, see migrations
+	Version               int `yaml:"Version,omitempty"`
 	host                  `yaml:",inline"`
-	ServerAliveInterval   int    `yaml:"ServerAliveInterval"`
-	ServerAliveCountMax   int    `yaml:"ServerAliveCountMax"`
-	StrictHostKeyChecking string `yaml:"StrictHostKeyChecking"`
-	IdentityFile          string `yaml:"IdentityFile"`
-	ProxyCommand          string `yaml:"ProxyCommand"`
-	LocalBindAddress      string `yaml:"LocalBindAddress"`
+	ServerAliveInterval   int      `yaml:"ServerAliveInterval,omitempty"`
+	ServerAliveCountMax   int      `yaml:"ServerAliveCountMax,omitempty"`
+	StrictHostKeyChecking string   `yaml:"StrictHostKeyChecking,omitempty"`
+	IdentityFile          string   `yaml:"IdentityFile,omitempty"`
+	ProxyCommand          string   `yaml:"ProxyCommand,omitempty"`
+	LocalBindAddress      string   `yaml:"LocalBindAddress"`
+	Backend               string   `yaml:"Backend,omitempty"`
+	Reconnect             backoff  `yaml:"Reconnect,omitempty"`
+	Groups                []string `yaml:"Groups,omitempty"`
+	DependsOn             []string `yaml:"DependsOn,omitempty"`
+	Tags                  []string `yaml:"Tags,omitempty"`
+
+	Name string `yaml:"-"`
 }
 
 // Message adds simple message
@@ -49,18 +137,41 @@ func Message(response *gofred.Response, title, subtitle string, err bool) {
 	fmt.Println(response)
 }
 
-func init() {
-	flag.Parse()
+const configFolder = "conf"
+
+// workflowDataPath returns Alfred's data folder for the workflow, or
+// ~/.sshtunnel when run outside of Alfred
+func workflowDataPath() string {
+	dataPath := os.Getenv("alfred_workflow_data")
+	if len(dataPath) == 0 {
+		dataPath = expandHome("~/.sshtunnel")
+	}
+	return dataPath
 }
 
-const configFolder = "conf"
+// exitOnError ends a subcommand with the exit code that fits its error
+func exitOnError(err error) {
+	if err == errNotRunning {
+		os.Exit(exitNotRunning)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		os.Exit(exitCode(err))
+	}
+}
 
 func main() {
+	flag.Usage = func() {
+		fmt.Fprint(os.Stderr, usage)
+	}
+	flag.Parse()
+
 	path := os.Getenv("PATH")
 	if !strings.Contains(path, "/usr/local/bin") {
 		os.Setenv("PATH", path+":/usr/local/bin")
 	}
-	configPath := os.Getenv("alfred_workflow_data") + "/" + configFolder
+	dataPath := workflowDataPath()
+	configPath := dataPath + "/" + configFolder
 	response := gofred.NewResponse()
 
 	err := os.MkdirAll(configPath, os.ModePerm)
@@ -69,137 +180,424 @@ func main() {
 		return
 	}
 
-	configs, err := ioutil.ReadDir(configPath)
+	switch flag.Arg(0) {
+	case "tunnel":
+		exitOnError(runTunnel(dataPath, configPath, flag.Arg(1)))
+		return
+	case "daemon":
+		exitOnError(runDaemon(dataPath, configPath, flag.Args()[1:]))
+		return
+	case "import-ssh-config":
+		exitOnError(runImport(configPath, flag.Args()[1:]))
+		return
+	case "export-ssh-config":
+		exitOnError(runExport(configPath, flag.Args()[1:]))
+		return
+	case "logs":
+		exitOnError(runLogs(dataPath, flag.Args()[1:]))
+		return
+	case "show":
+		exitOnError(runShow(configPath, flag.Args()[1:]))
+		return
+	case "migrate":
+		exitOnError(runMigrate(dataPath, flag.Args()[1:]))
+		return
+	case "validate":
+		exitOnError(runValidate(dataPath, configPath, flag.Arg(1)))
+		return
+	case "help":
+		fmt.Print(usage)
+		return
+	case "list":
+		exitOnError(runList(dataPath, configPath))
+		return
+	case "start", "stop", "restart", "status":
+		exitOnError(runClient(dataPath, configPath, flag.Arg(0), flag.Args()[1:]))
+		return
+	case "group":
+		exitOnError(runGroup(dataPath, configPath, flag.Args()[1:]))
+		return
+	case "alias":
+		exitOnError(runAlias(configPath))
+		return
+	case "alfred":
+		// the script filter passes the whole query as one argument
+		runAlfred(response, dataPath, configPath, strings.Fields(strings.Join(flag.Args()[1:], " ")))
+		return
+	case "":
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n", flag.Arg(0))
+	}
+	flag.Usage()
+	os.Exit(exitUsage)
+}
+
+// runAlfred answers the script filter with the list of tunnels and groups
+// that match the query, or with the item that creates a config when the
+// query starts with create
+func runAlfred(response *gofred.Response, dataPath, configPath string, query []string) {
+	names, err := configNames(configPath)
 	if err != nil {
 		Message(response, "error", err.Error(), true)
 		return
 	}
-	loopback, err := exec.Command("bash", "-c", "ifconfig | grep 127.0.0 | awk '{print $2}'").CombinedOutput()
+	loopback, err := loopbackAddresses()
 	if err != nil {
 		Message(response, "error", err.Error(), true)
 		return
 	}
 
-	lists := strings.Fields(string(loopback))
-
-	items := []gofred.Item{}
-	if flag.Arg(0) != "create" {
-		aliasCommand := ""
-		for _, config := range configs {
-			var remote Config
-			bt, err := ioutil.ReadFile(configPath + "/" + config.Name())
-			if err != nil {
-				Message(response, "error", err.Error(), true)
-				return
-			}
-
-			err = yaml.Unmarshal(bt, &remote)
+	statuses, err := currentStatus(dataPath, configPath)
+	if err != nil {
+		Message(response, "error", err.Error(), true)
+		return
+	}
+	list := &itemResponse{}
+	items := []item{}
+	if len(query) == 0 || query[0] != "create" {
+		healths := runningHealth(configPath, statuses)
+		notAliased := []string{}
+		for _, name := range names {
+			remote, err := loadConfig(configPath, name)
 			if err != nil {
-				Message(response, "error", err.Error(), true)
-				return
-			}
-			valid := valid(remote)
-			found := false
-			for _, list := range lists {
-				if remote.LocalBindAddress == list {
-					found = true
-					break
-				}
+				items = append(items, unloadableItem(name, err, statuses[name]))
+				continue
 			}
-
-			if !found {
-				if len(aliasCommand) > 0 {
-					aliasCommand += " && "
+			problems := validate(remote)
+			// an address that isn't one is shown as the item's problem
+			// instead of being aliased
+			if needsAlias(remote, problems, loopback) {
+				if !contains(notAliased, remote.LocalBindAddress) {
+					notAliased = append(notAliased, remote.LocalBindAddress)
 				}
-				aliasCommand += fmt.Sprintf("ifconfig lo0 alias %s", remote.LocalBindAddress)
 				continue
 			}
 
-			name := strings.TrimSuffix(config.Name(), ".yml")
-			shellCommand := runCommand(remote)
-			rebootCommand := shellCommand
 			status := "Off"
 			command := "Start"
-			n, err := exec.Command("bash", "-c", fmt.Sprintf("ps aux | grep ssh | grep -v grep | grep %s | wc -l", remote.LocalBindAddress)).CombinedOutput()
-			if err == nil {
-				number, err := strconv.Atoi(strings.TrimSpace(string(n)))
-				if err == nil && number > 0 {
-					status = "On"
-					command = "Stop"
-					shellCommand = fmt.Sprintf("kill -9 $(ps aux | grep ssh | grep -v grep | grep %s | awk '{print $2}')", remote.LocalBindAddress)
-					rebootCommand = "(" + shellCommand + ") && " + rebootCommand
+			tunnel := statuses[name]
+			if tunnel.running() {
+				status = "On"
+				command = "Stop"
+			}
+			subtitle := command + " " + name
+			if labels := forwardLabels(remote); len(labels) > 0 {
+				subtitle += " [" + strings.Join(labels, ", ") + "]"
+			}
+			if len(remote.RemoteForwards) > 0 {
+				subtitle += " " + remoteForwardsSummary(remote)
+			}
+			if status == "On" && tunnel.ConfigChanged {
+				subtitle += " (config changed, reboot to apply)"
+			}
+			if status == "On" {
+				if names, err := dependents(configPath, name); err == nil {
+					needed := []string{}
+					for _, other := range names {
+						if statuses[other].running() {
+							needed = append(needed, other)
+						}
+					}
+					if len(needed) > 0 {
+						subtitle += " (needed by " + strings.Join(needed, ", ") + ")"
+					}
+				}
+			}
+			if events, err := readHistory(dataPath, name); err == nil {
+				if summary := historySummary(events); len(summary) > 0 {
+					subtitle += " - " + summary
+				}
+			}
+			icon := status + ".png"
+			if status == "On" {
+				// the tunnel process is up, check that its ports are too
+				h := healths[name]
+				if h.State != healthHealthy {
+					icon = healthIcons[h.State]
+					subtitle = command + " " + name + " - " + h.String()
+				}
+			}
+			// a running tunnel can always be stopped, a stopped one is only
+			// started when nothing is in its way
+			executable := status == "On"
+			if !executable {
+				executable = len(problems) == 0
+				if executable {
+					if conflicts := checkPorts(configPath, remote); len(conflicts) > 0 {
+						subtitle = conflicts[0].String()
+						executable = false
+					}
+				} else {
+					subtitle = problems[0].String()
 				}
 			}
-			item := gofred.NewItem(name, command+" "+name, noAutocomplete).AddIcon(status+".png", "").
-				AddVariables(gofred.NewVariable("name", name), gofred.NewVariable("cmd", command), gofred.NewVariable("remote", remote.LocalBindAddress)).
+			it := gofred.NewItem(name, subtitle, noAutocomplete).AddIcon(icon, "").
+				AddVariables(gofred.NewVariable("name", name), gofred.NewVariable("cmd", strings.ToLower(command))).
 				AddOptionKeyAction("Modify config", "modify", true).AddOptionKeyVariables(gofred.NewVariable("name", name), gofred.NewVariable("cmd", "modify")).
 				AddCtrlKeyAction("Remove config", "remove", true).AddCtrlKeyVariables(gofred.NewVariable("name", name), gofred.NewVariable("cmd", "remove"))
-			if valid {
-				item = item.Executable(shellCommand)
-				if status == "On" {
-					item = item.AddCommandKeyAction("Reboot "+name, rebootCommand, true).
-						AddCommandKeyVariables(gofred.NewVariable("name", name), gofred.NewVariable("cmd", "reboot"), gofred.NewVariable("remote", remote.LocalBindAddress))
+			if executable {
+				it = it.Executable(name)
+				if status == "On" && len(problems) == 0 {
+					it = it.AddCommandKeyAction("Reboot "+name, name, true).
+						AddCommandKeyVariables(gofred.NewVariable("name", name), gofred.NewVariable("cmd", "restart"))
 				}
 			}
 
-			items = append(items, item)
+			tunnelItem := newItem(it).addMatch(matchText(remote))
+			if _, err := os.Stat(logPath(dataPath, name)); err == nil {
+				tunnelItem = tunnelItem.addShiftKeyAction("Show recent log lines", name, true,
+					gofred.NewVariable("name", name), gofred.NewVariable("cmd", "logs"))
+			}
+
+			items = append(items, tunnelItem)
+		}
+
+		groups, err := loadGroups(dataPath, configPath)
+		if err != nil {
+			Message(response, "error", err.Error(), true)
+			return
 		}
-		if len(aliasCommand) > 0 {
-			items = []gofred.Item{gofred.NewItem("Not Aliased on loopback list", "Run alias command", noAutocomplete).
-				AddIcon("icon.png", "").AddVariables(gofred.NewVariable("cmd", "alias")).Executable(fmt.Sprintf(`osascript -e "do shell script \"%s\" with administrator privileges"`, aliasCommand))}
+		for _, g := range groups {
+			items = append(items, groupItem(g, statuses))
 		}
-		items = append(items, gofred.NewItem("Add new config", noSubtitle, "create ").AddIcon("plus.png", ""))
+		if len(notAliased) > 0 {
+			list.addItems(newItem(gofred.NewItem("Not Aliased on loopback list", "Run alias command", noAutocomplete).
+				AddIcon("icon.png", "").AddVariables(gofred.NewVariable("cmd", "alias")).Executable("alias")))
+		} else {
+			list.addItems(matchItems(strings.Join(query, " "), items)...)
+		}
+		list.addItems(newItem(gofred.NewItem("Add new config", noSubtitle, "create ").AddIcon("plus.png", "")))
 	} else {
-		items = append(items, gofred.NewItem("Add new config", fmt.Sprintf("write name ... \"%s\"", flag.Arg(1)), noAutocomplete).
-			AddIcon("plus.png", "").AddVariables(gofred.NewVariable("filename", flag.Arg(1)), gofred.NewVariable("cmd", "new")).Executable("new"))
+		filename := ""
+		if len(query) > 1 {
+			filename = query[1]
+		}
+		list.addItems(newItem(gofred.NewItem("Add new config", fmt.Sprintf("write name ... \"%s\"", filename), noAutocomplete).
+			AddIcon("plus.png", "").AddVariables(gofred.NewVariable("filename", filename), gofred.NewVariable("cmd", "new")).Executable("new")))
 	}
-	response.AddItems(items...)
-	fmt.Println(response)
+	fmt.Println(list)
 }
 
-func valid(conf Config) bool {
-	if len(conf.LocalBindAddress) == 0 {
-		return false
+// unloadableItem shows a config that can't be loaded with the reason. It
+// can still be modified and removed, and stopped if it is running.
+func unloadableItem(name string, err error, tunnel tunnelStatus) item {
+	subtitle := strings.TrimPrefix(err.Error(), name+": ")
+	it := gofred.NewItem(name, subtitle, noAutocomplete).AddIcon("Off.png", "").
+		AddOptionKeyAction("Modify config", "modify", true).AddOptionKeyVariables(gofred.NewVariable("name", name), gofred.NewVariable("cmd", "modify")).
+		AddCtrlKeyAction("Remove config", "remove", true).AddCtrlKeyVariables(gofred.NewVariable("name", name), gofred.NewVariable("cmd", "remove"))
+	if tunnel.running() {
+		it = it.AddIcon("On.png", "").AddVariables(gofred.NewVariable("name", name), gofred.NewVariable("cmd", "stop")).
+			Executable(name)
+		it.Subtitle = "Stop " + name + " - " + subtitle
 	}
-	if len(conf.RemoteUser) == 0 {
-		return false
+	return newItem(it)
+}
+
+// groupItem shows how many members of a group are running. It stops all of
+// them when all are running and starts the rest otherwise.
+func groupItem(g group, statuses map[string]tunnelStatus) item {
+	running := g.countRunning(statuses)
+	status := "Off"
+	icon := "Off.png"
+	command := "Start"
+	switch {
+	case running == len(g.Members):
+		status = "On"
+		icon = "On.png"
+		command = "Stop"
+	case running > 0:
+		status = "On"
+		icon = healthIcons[healthDegraded]
+	}
+	subtitle := fmt.Sprintf("%d/%d On - %s %s", running, len(g.Members), command, strings.Join(g.Members, ", "))
+	it := gofred.NewItem(g.Name, subtitle, noAutocomplete).AddIcon(icon, "").
+		AddVariables(gofred.NewVariable("group", g.Name), gofred.NewVariable("cmd", strings.ToLower(command))).
+		Executable(g.Name)
+	if status == "On" {
+		it = it.AddCommandKeyAction("Reboot all of "+g.Name, g.Name, true).
+			AddCommandKeyVariables(gofred.NewVariable("group", g.Name), gofred.NewVariable("cmd", "restart"))
+	}
+	return newItem(it).addMatch(strings.Join(g.Members, " "))
+}
+
+// matchText is what a query is matched against besides the name of a
+// tunnel: its hosts, user, ports, labels and tags
+func matchText(conf Config) string {
+	words := []string{conf.RemoteUser, conf.RemoteHost, conf.RemoteUser + "@" + conf.RemoteHost, conf.RemotePort, conf.LocalBindAddress}
+	for _, fw := range conf.ForwardPorts {
+		words = append(words, fw.LocalPort, fw.RemoteHost, fw.RemotePort, fw.Label)
 	}
-	if len(conf.RemoteHost) == 0 {
-		return false
+	for _, fw := range conf.RemoteForwards {
+		words = append(words, fw.RemotePort, fw.LocalPort)
+	}
+	words = append(words, conf.DynamicForwards...)
+	for _, hop := range conf.JumpHosts {
+		words = append(words, hop.Host)
+	}
+	words = append(words, conf.Tags...)
+	return strings.Join(strings.Fields(strings.Join(words, " ")), " ")
+}
+
+// forwardLabels returns the labels of the local forwards that have one
+func forwardLabels(conf Config) []string {
+	labels := []string{}
+	for _, fw := range conf.ForwardPorts {
+		if len(fw.Label) > 0 {
+			labels = append(labels, fw.Label)
+		}
+	}
+	return labels
+}
+
+// remoteForwardsSummary describes the remote forwards for an item subtitle
+func remoteForwardsSummary(conf Config) string {
+	specs := []string{}
+	for _, fw := range conf.RemoteForwards {
+		specs = append(specs, fmt.Sprintf("%s → %s", fw.remote(), fw.local()))
+	}
+	return "(remote " + strings.Join(specs, ", ") + ")"
+}
+
+// loadConfig reads a config and rejects it if it depends on itself
+func loadConfig(configPath, name string) (Config, error) {
+	conf, err := readConfig(configPath, name)
+	if err != nil {
+		return conf, err
 	}
-	return true
+	return conf, checkDependencyCycle(configPath, conf)
 }
 
-func runCommand(conf Config) string {
-	cmd := fmt.Sprintf("/usr/local/bin/autossh -M 0 -f -q -N")
+func readConfig(configPath, name string) (Config, error) {
+	conf, _, err := resolveConfig(configPath, name)
+	return conf, err
+}
+
+// resolveConfig reads a config with defaults.yml and the profiles it
+// extends merged in and its variables expanded, and returns the files that
+// were merged under it
+func resolveConfig(configPath, name string) (Config, []string, error) {
+	var conf Config
+	doc, err := readDocument(configPath + "/" + name + ".yml")
+	if os.IsNotExist(err) {
+		return conf, nil, fmt.Errorf("%s does not exist", name)
+	}
+	if err != nil {
+		return conf, nil, fmt.Errorf("%s: %s", name, err.Error())
+	}
+	doc, sources, err := resolveDocument(configPath, doc)
+	if err != nil {
+		return conf, nil, fmt.Errorf("%s: %s", name, err.Error())
+	}
+	bt, err := yaml.Marshal(doc)
+	if err != nil {
+		return conf, nil, err
+	}
+	err = yaml.Unmarshal(bt, &conf)
+	conf.Name = name
+	if err != nil {
+		return conf, nil, fmt.Errorf("%s: %s", name, err.Error())
+	}
+	err = expandConfig(&conf)
+	if err != nil {
+		return conf, nil, fmt.Errorf("%s: %s", name, err.Error())
+	}
+	return conf, sources, nil
+}
+
+// sshArgs returns the ssh options and destination for a config
+func sshArgs(conf Config) []string {
+	args := []string{}
 	if len(conf.RemotePort) > 0 {
-		cmd += fmt.Sprintf(" -p %s", conf.RemotePort)
+		args = append(args, "-p", conf.RemotePort)
 	}
 	if len(conf.IdentityFile) > 0 {
-		cmd += fmt.Sprintf(" -i %s", conf.IdentityFile)
+		args = append(args, "-i", conf.IdentityFile)
 	}
 	if conf.ServerAliveInterval > 0 {
-		cmd += fmt.Sprintf(" -o ServerAliveInterval=%d", conf.ServerAliveInterval)
+		args = append(args, "-o", fmt.Sprintf("ServerAliveInterval=%d", conf.ServerAliveInterval))
 	}
 	if conf.ServerAliveCountMax > 0 {
-		cmd += fmt.Sprintf(" -o ServerAliveCountMax=%d", conf.ServerAliveCountMax)
+		args = append(args, "-o", fmt.Sprintf("ServerAliveCountMax=%d", conf.ServerAliveCountMax))
 	}
 	if len(conf.StrictHostKeyChecking) > 0 {
-		cmd += fmt.Sprintf(" -o StrictHostKeyChecking=%s", conf.StrictHostKeyChecking)
+		args = append(args, "-o", "StrictHostKeyChecking="+conf.StrictHostKeyChecking)
 	}
 
 	if len(conf.ProxyCommand) > 0 {
-		cmd += fmt.Sprintf(" -o ProxyCommand=\"%s\"", conf.ProxyCommand)
+		args = append(args, "-o", "ProxyCommand="+conf.ProxyCommand)
+	}
+	if len(conf.JumpHosts) > 0 {
+		args = append(args, jumpArgs(conf.JumpHosts)...)
+	}
+
+	for _, fw := range conf.forwards() {
+		args = append(args, "-L", fw.String())
+	}
+	for _, fw := range conf.RemoteForwards {
+		args = append(args, "-R", fw.String())
+	}
+	for _, port := range conf.DynamicForwards {
+		args = append(args, "-D", net.JoinHostPort(conf.LocalBindAddress, port))
 	}
 
-	if len(conf.ForwardPorts) > 0 {
-		forwardPorts := ""
-		for _, str := range conf.ForwardPorts {
-			forwardPorts += fmt.Sprintf(" -L %s%s", conf.LocalBindAddress, str)
+	args = append(args, conf.RemoteUser+"@"+conf.RemoteHost)
+	return args
+}
+
+// jumpArgs renders the jump hosts as -J, or as nested ProxyCommands when a
+// hop needs its own identity file since -J can't pass one
+func jumpArgs(hops []jumpHost) []string {
+	identities := false
+	specs := []string{}
+	for _, hop := range hops {
+		specs = append(specs, hop.String())
+		if len(hop.IdentityFile) > 0 {
+			identities = true
 		}
-		cmd += forwardPorts
+	}
+	if !identities {
+		return []string{"-J", strings.Join(specs, ",")}
 	}
 
-	cmd += fmt.Sprintf(" %s@%s", conf.RemoteUser, conf.RemoteHost)
-	return cmd
+	proxyCommand := ""
+	for _, hop := range hops {
+		args := []string{"ssh"}
+		if len(hop.Port) > 0 {
+			args = append(args, "-p", hop.Port)
+		}
+		if len(hop.IdentityFile) > 0 {
+			args = append(args, "-i", hop.IdentityFile)
+		}
+		if len(proxyCommand) > 0 {
+			// the outer ssh expands % sequences once more before running it
+			args = append(args, "-o", "ProxyCommand="+strings.Replace(proxyCommand, "%", "%%", -1))
+		}
+		dest := hop.Host
+		if len(hop.User) > 0 {
+			dest = hop.User + "@" + dest
+		}
+		args = append(args, "-W", "%h:%p", dest)
+		proxyCommand = shellJoin(args...)
+	}
+	return []string{"-o", "ProxyCommand=" + proxyCommand}
+}
+
+// shellQuote quotes a word for sh when it needs to be
+func shellQuote(word string) string {
+	if len(word) > 0 && strings.IndexFunc(word, func(r rune) bool {
+		return !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || strings.ContainsRune("@%+=:,./_-", r))
+	}) < 0 {
+		return word
+	}
+	return "'" + strings.Replace(word, "'", `'\''`, -1) + "'"
+}
+
+// shellJoin renders a command line for sh with every word quoted as needed,
+// so no value in it is ever taken as shell syntax
+func shellJoin(argv ...string) string {
+	quoted := []string{}
+	for _, arg := range argv {
+		quoted = append(quoted, shellQuote(arg))
+	}
+	return strings.Join(quoted, " ")
 }
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"os/exec"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// hostile are values that mean something to sh or to ssh
+var hostile = []string{
+	"plain",
+	"",
+	"it's",
+	`"double"`,
+	"$(touch /tmp/pwned)",
+	"`touch /tmp/pwned`",
+	"${HOME}",
+	"a;b",
+	"a|b",
+	"a && b",
+	"-oProxyCommand=touch /tmp/pwned",
+	"line\nbreak",
+	"tab\there",
+	"back\\slash",
+	"*",
+	"~",
+	"%h:%p",
+	"ünïcode",
+}
+
+// shWords runs a command line with sh and returns the words it was split
+// into
+func shWords(t *testing.T, line string) []string {
+	t.Helper()
+	out, err := exec.Command("sh", "-c", "set -- "+line+"\n"+`for word in "$@"; do printf '%s\0' "$word"; done`).Output()
+	if err != nil {
+		t.Fatalf("sh -c %q: %v", line, err)
+	}
+	words := strings.Split(string(out), "\x00")
+	return words[:len(words)-1]
+}
+
+func TestShellQuote(t *testing.T) {
+	for _, value := range hostile {
+		got := shWords(t, shellQuote(value))
+		if len(got) != 1 || got[0] != value {
+			t.Errorf("shellQuote(%q) = %s, sh reads it as %q", value, shellQuote(value), got)
+		}
+	}
+}
+
+func TestShellJoin(t *testing.T) {
+	argv := append([]string{"/Applications/Alfred 4.app/sshtunnel", "start"}, hostile...)
+	got := shWords(t, shellJoin(argv...))
+	if !reflect.DeepEqual(got, argv) {
+		t.Errorf("shellJoin(%q) is read by sh as %q", argv, got)
+	}
+	if line := shellJoin("sshtunnel", "start", "db"); line != "sshtunnel start db" {
+		t.Errorf("shellJoin quoted plain words: %s", line)
+	}
+}
+
+func TestSSHArgs(t *testing.T) {
+	for _, value := range hostile {
+		if len(value) == 0 {
+			continue
+		}
+		conf := Config{
+			host: host{
+				RemoteUser: value,
+				RemoteHost: "example.com",
+				RemotePort: "22",
+			},
+			IdentityFile:          value,
+			StrictHostKeyChecking: "no",
+		}
+		args := sshArgs(conf)
+		want := []string{"-p", "22", "-i", value, "-o", "StrictHostKeyChecking=no", value + "@example.com"}
+		if !reflect.DeepEqual(args, want) {
+			t.Errorf("sshArgs with %q = %q, want %q", value, args, want)
+		}
+	}
+}
+
+func TestJumpArgs(t *testing.T) {
+	hops := []jumpHost{{User: "jump", Host: "bastion", Port: "2222"}, {Host: "inner"}}
+	if got, want := jumpArgs(hops), []string{"-J", "jump@bastion:2222,inner"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("jumpArgs = %q, want %q", got, want)
+	}
+
+	for _, value := range hostile {
+		if len(value) == 0 {
+			continue
+		}
+		hops := []jumpHost{
+			{User: "jump", Host: "bastion", IdentityFile: value},
+			{Host: "inner", IdentityFile: value},
+		}
+		args := jumpArgs(hops)
+		if len(args) != 2 || args[0] != "-o" || !strings.HasPrefix(args[1], "ProxyCommand=") {
+			t.Fatalf("jumpArgs with identity files = %q", args)
+		}
+		// ssh runs a ProxyCommand with sh, after expanding % sequences
+		outer := shWords(t, strings.TrimPrefix(args[1], "ProxyCommand="))
+		want := []string{"ssh", "-i", value, "-o", "", "-W", "%h:%p", "inner"}
+		if len(outer) != len(want) || !strings.HasPrefix(outer[4], "ProxyCommand=") {
+			t.Fatalf("outer ProxyCommand with %q is read by sh as %q", value, outer)
+		}
+		inner := strings.Replace(strings.TrimPrefix(outer[4], "ProxyCommand="), "%%", "%", -1)
+		outer[4] = ""
+		if !reflect.DeepEqual(outer, want) {
+			t.Errorf("outer ProxyCommand with %q is read by sh as %q, want %q", value, outer, want)
+		}
+		want = []string{"ssh", "-i", value, "-W", "%h:%p", "jump@bastion"}
+		if got := shWords(t, inner); !reflect.DeepEqual(got, want) {
+			t.Errorf("inner ProxyCommand with %q is read by sh as %q, want %q", value, got, want)
+		}
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// matchItems returns the items whose title or match field fuzzy matches
+// every word of the query, ignoring case, best matches first
+func matchItems(query string, items []item) []item {
+	words := strings.Fields(query)
+	if len(words) == 0 {
+		return items
+	}
+	type scored struct {
+		item  item
+		score int
+	}
+	matched := []scored{}
+	for _, it := range items {
+		if score := matchScore(words, it.Title, it.Match); score > 0 {
+			matched = append(matched, scored{it, score})
+		}
+	}
+	sort.SliceStable(matched, func(i, j int) bool {
+		return matched[i].score > matched[j].score
+	})
+	result := []item{}
+	for _, m := range matched {
+		result = append(result, m.item)
+	}
+	return result
+}
+
+// substringScore scores pattern as a part of str, ignoring case, higher at
+// the start of a word. It returns 0 if str doesn't contain pattern.
+func substringScore(pattern, str string) int {
+	p := []rune(strings.ToLower(pattern))
+	s := []rune(strings.ToLower(str))
+	best := 0
+	for i := 0; i+len(p) <= len(s); i++ {
+		if string(s[i:i+len(p)]) != string(p) {
+			continue
+		}
+		score := 100 + 10*len(p)
+		if i == 0 || isSeparator(s[i-1]) {
+			score += 50
+		}
+		if score > best {
+			best = score
+		}
+	}
+	return best
+}
+
+// fuzzyScore scores how well pattern matches str, ignoring case. A pattern
+// that is part of str scores highest, then one whose letters all appear in
+// str in order. It returns 0 if pattern doesn't match at all.
+func fuzzyScore(pattern, str string) int {
+	if score := substringScore(pattern, str); score > 0 {
+		return score
+	}
+	p := []rune(strings.ToLower(pattern))
+	s := []rune(strings.ToLower(str))
+	score, pi, prev := 0, 0, -2
+	for si, r := range s {
+		if pi == len(p) {
+			break
+		}
+		if r != p[pi] {
+			continue
+		}
+		score++
+		if si == prev+1 {
+			score += 5
+		}
+		if si == 0 || isSeparator(s[si-1]) {
+			score += 10
+		}
+		prev = si
+		pi++
+	}
+	if pi < len(p) {
+		return 0
+	}
+	return score
+}
+
+func isSeparator(r rune) bool {
+	return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+}
+
+// matchScore scores a title and match text against every word of a query.
+// The title is matched fuzzily and counts twice, the match text only by its
+// parts. It returns 0 if any word doesn't match.
+func matchScore(words []string, title, match string) int {
+	total := 0
+	for _, word := range words {
+		score := 2 * fuzzyScore(word, title)
+		if len(match) > 0 {
+			if alt := substringScore(word, match); alt > score {
+				score = alt
+			}
+		}
+		if score == 0 {
+			return 0
+		}
+		total += score
+	}
+	return total
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// tunnelMetrics counts what a tunnel run by the daemon does. Bytes and
+// connections are only known for native tunnels, since ssh does the
+// forwarding for the others.
+type tunnelMetrics struct {
+	connects int64
+
+	mu       sync.Mutex
+	latency  time.Duration
+	forwards map[forwardKey]*forwardMetrics
+}
+
+// forwardKey names a forward the way status -json does, by its type and
+// the address it listens on
+type forwardKey struct {
+	Type, Listen string
+}
+
+// forwardMetrics counts the traffic of a single forward. Upstream is what
+// the side that connected sent, downstream is what it got back.
+type forwardMetrics struct {
+	upstream   int64
+	downstream int64
+	active     int64
+}
+
+func newTunnelMetrics() *tunnelMetrics {
+	return &tunnelMetrics{forwards: make(map[forwardKey]*forwardMetrics)}
+}
+
+// forward returns the counters of a forward, adding them on first use
+func (m *tunnelMetrics) forward(key forwardKey) *forwardMetrics {
+	if m == nil {
+		return &forwardMetrics{}
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	fm, ok := m.forwards[key]
+	if !ok {
+		fm = &forwardMetrics{}
+		m.forwards[key] = fm
+	}
+	return fm
+}
+
+func (m *tunnelMetrics) setLatency(d time.Duration) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	m.latency = d
+	m.mu.Unlock()
+}
+
+// countingConn adds everything read from a connection to a counter
+type countingConn struct {
+	net.Conn
+	count *int64
+}
+
+func (c countingConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	atomic.AddInt64(c.count, int64(n))
+	return n, err
+}
+
+// open counts a connection through a forward until the returned func is
+// called
+func (fm *forwardMetrics) open() func() {
+	atomic.AddInt64(&fm.active, 1)
+	return func() {
+		atomic.AddInt64(&fm.active, -1)
+	}
+}
+
+// writeMetrics writes the metrics of every tunnel the supervisor owns in the
+// Prometheus text format
+func (s *supervisor) writeMetrics(w io.Writer) {
+	s.mu.Lock()
+	names := make([]string, 0, len(s.tunnels))
+	tunnels := map[string]*managedTunnel{}
+	for name, tunnel := range s.tunnels {
+		names = append(names, name)
+		tunnels[name] = tunnel
+	}
+	s.mu.Unlock()
+	sort.Strings(names)
+
+	type sample struct {
+		labels string
+		value  interface{}
+	}
+	series := []struct {
+		name, kind, help string
+		samples          []sample
+	}{
+		{"sshtunnel_up", "gauge", "Whether the tunnel is connected.", nil},
+		{"sshtunnel_reconnects_total", "counter", "Connection attempts after the first one.", nil},
+		{"sshtunnel_connect_latency_seconds", "gauge", "How long the last connection took to be established.", nil},
+		{"sshtunnel_forward_bytes_total", "counter", "Bytes that went through a forward.", nil},
+		{"sshtunnel_forward_active_connections", "gauge", "Connections open through a forward.", nil},
+	}
+	for _, name := range names {
+		tunnel := tunnels[name]
+		label := "tunnel=" + labelValue(name)
+		up := 0
+		if tunnel.status().State == stateOn {
+			up = 1
+		}
+		m := tunnel.metrics
+		m.mu.Lock()
+		latency := m.latency
+		forwards := make([]forwardKey, 0, len(m.forwards))
+		for key := range m.forwards {
+			forwards = append(forwards, key)
+		}
+		m.mu.Unlock()
+		sort.Slice(forwards, func(i, j int) bool {
+			if forwards[i].Type != forwards[j].Type {
+				return forwards[i].Type < forwards[j].Type
+			}
+			return forwards[i].Listen < forwards[j].Listen
+		})
+
+		series[0].samples = append(series[0].samples, sample{label, up})
+		reconnects := atomic.LoadInt64(&m.connects) - 1
+		if reconnects < 0 {
+			reconnects = 0
+		}
+		series[1].samples = append(series[1].samples, sample{label, reconnects})
+		if latency > 0 {
+			series[2].samples = append(series[2].samples, sample{label, latency.Seconds()})
+		}
+		for _, key := range forwards {
+			fm := m.forward(key)
+			fwLabel := label + ",type=" + labelValue(key.Type) + ",forward=" + labelValue(key.Listen)
+			series[3].samples = append(series[3].samples,
+				sample{fwLabel + `,direction="upstream"`, atomic.LoadInt64(&fm.upstream)},
+				sample{fwLabel + `,direction="downstream"`, atomic.LoadInt64(&fm.downstream)})
+			series[4].samples = append(series[4].samples, sample{fwLabel, atomic.LoadInt64(&fm.active)})
+		}
+	}
+
+	for _, metric := range series {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", metric.name, metric.help, metric.name, metric.kind)
+		for _, sample := range metric.samples {
+			fmt.Fprintf(w, "%s{%s} %v\n", metric.name, sample.labels, sample.value)
+		}
+	}
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// labelValue quotes a label value the way the text format wants it
+func labelValue(value string) string {
+	return `"` + labelEscaper.Replace(value) + `"`
+}
+
+// serveMetrics serves /metrics on addr until the listener fails
+func (s *supervisor) serveMetrics(addr string) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		s.writeMetrics(w)
+	})
+	if !strings.Contains(addr, ":") {
+		addr = "127.0.0.1:" + addr
+	}
+	return http.ListenAndServe(addr, mux)
+}
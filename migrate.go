@@ -0,0 +1,215 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// backupFolder keeps the files migrate replaced, outside of the folders
+// configs are read from
+const backupFolder = "backups"
+
+// migrations upgrade a document by one version, migrations[i] from Version
+// i+1 to i+2. A file without a Version is Version 1, the schema from before
+// there was one.
+var migrations = []func(doc document){
+	migrateForwardStrings,
+}
+
+// configVersion is the Version of the schema this build reads and writes
+var configVersion = len(migrations) + 1
+
+// migrateDocument upgrades a document to configVersion in place and returns
+// the Version it was written in
+func migrateDocument(doc document) (int, error) {
+	version := 1
+	if value, ok := doc["Version"]; ok {
+		n, ok := value.(int)
+		if !ok || n < 1 {
+			return 0, fmt.Errorf("Version: %v is not a version", value)
+		}
+		version = n
+	}
+	if version > configVersion {
+		return 0, fmt.Errorf("Version %d is newer than this sshtunnel, which reads up to %d", version, configVersion)
+	}
+	for v := version; v < configVersion; v++ {
+		migrations[v-1](doc)
+	}
+	doc["Version"] = configVersion
+	return version, nil
+}
+
+// migrateForwardStrings turns ForwardPorts written as :port:host:hostport
+// strings, the only form Version 1 had, into mappings. A string that can't
+// be parsed is kept so validation can report it.
+func migrateForwardStrings(doc document) {
+	forwards, ok := doc["ForwardPorts"].([]interface{})
+	if !ok {
+		return
+	}
+	for i, value := range forwards {
+		spec, ok := value.(string)
+		if !ok {
+			continue
+		}
+		fw := parseForward(spec)
+		if len(fw.LocalPort) == 0 {
+			continue
+		}
+		mapping := document{"LocalPort": fw.LocalPort, "RemoteHost": fw.RemoteHost, "RemotePort": fw.RemotePort}
+		if len(fw.BindAddress) > 0 {
+			mapping["BindAddress"] = fw.BindAddress
+		}
+		forwards[i] = mapping
+	}
+}
+
+// documentFiles returns every file a config can be read from: the configs,
+// the profiles and defaults.yml, relative to the data folder
+func documentFiles(dataPath string) ([]string, error) {
+	files := []string{}
+	for _, folder := range []string{configFolder, profileFolder} {
+		infos, err := ioutil.ReadDir(filepath.Join(dataPath, folder))
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		for _, info := range infos {
+			if strings.HasSuffix(info.Name(), ".yml") {
+				files = append(files, filepath.Join(folder, info.Name()))
+			}
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dataPath, defaultsFile)); err == nil {
+		files = append(files, defaultsFile)
+	}
+	return files, nil
+}
+
+// runMigrate rewrites every config, profile and defaults.yml that is older
+// than configVersion, keeping the old file in backupFolder
+func runMigrate(dataPath string, args []string) error {
+	flags := flag.NewFlagSet("migrate", flag.ContinueOnError)
+	dryRun := flags.Bool("dry-run", false, "only print what would be migrated")
+	err := flags.Parse(args)
+	if err != nil || flags.NArg() > 0 {
+		return usageError("sshtunnel migrate [-dry-run]")
+	}
+
+	files, err := documentFiles(dataPath)
+	if err != nil {
+		return err
+	}
+	suffix := time.Now().Format("20060102150405") + ".bak"
+	failed := 0
+	for _, file := range files {
+		path := filepath.Join(dataPath, file)
+		doc, err := readDocument(path)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", file, err.Error())
+			failed++
+			continue
+		}
+		version, err := migrateDocument(doc)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", file, err.Error())
+			failed++
+			continue
+		}
+		if version == configVersion {
+			fmt.Printf("%s: up to date\n", file)
+			continue
+		}
+		if *dryRun {
+			fmt.Printf("%s: would migrate from Version %d to %d\n", file, version, configVersion)
+			continue
+		}
+		backup := filepath.Join(backupFolder, file+"."+suffix)
+		err = rewriteDocument(path, filepath.Join(dataPath, backup), doc)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", file, err.Error())
+			failed++
+			continue
+		}
+		fmt.Printf("%s: migrated from Version %d to %d, the old file is %s\n", file, version, configVersion, backup)
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d files could not be migrated", failed, len(files))
+	}
+	return nil
+}
+
+// rewriteDocument copies a file to its backup and writes doc in its place
+func rewriteDocument(path, backup string, doc document) error {
+	bt, err := yaml.Marshal(orderedDocument(doc))
+	if err != nil {
+		return err
+	}
+	old, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Dir(backup), os.ModePerm)
+	if err != nil {
+		return err
+	}
+	err = ioutil.WriteFile(backup, old, 0644)
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	err = ioutil.WriteFile(tmp, bt, 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// orderedDocument orders the keys of a document like the fields of Config,
+// with Version and Extends first and keys Config doesn't know last
+func orderedDocument(doc document) yaml.MapSlice {
+	order := []string{"Version", "Extends"}
+	var fields func(t reflect.Type)
+	fields = func(t reflect.Type) {
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			tag := strings.Split(field.Tag.Get("yaml"), ",")
+			switch {
+			case field.Anonymous:
+				fields(field.Type)
+			case tag[0] != "" && tag[0] != "-" && !contains(order, tag[0]):
+				order = append(order, tag[0])
+			}
+		}
+	}
+	fields(reflect.TypeOf(Config{}))
+
+	ordered := yaml.MapSlice{}
+	for _, key := range order {
+		if value, ok := doc[key]; ok {
+			ordered = append(ordered, yaml.MapItem{Key: key, Value: value})
+		}
+	}
+	rest := []interface{}{}
+	for key := range doc {
+		if name, ok := key.(string); !ok || !contains(order, name) {
+			rest = append(rest, key)
+		}
+	}
+	sort.Slice(rest, func(i, j int) bool {
+		return fmt.Sprint(rest[i]) < fmt.Sprint(rest[j])
+	})
+	for _, key := range rest {
+		ordered = append(ordered, yaml.MapItem{Key: key, Value: doc[key]})
+	}
+	return ordered
+}
@@ -0,0 +1,478 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+const (
+	backendAutossh = "autossh"
+	backendNative  = "native"
+)
+
+const (
+	defaultSSHPort             = "22"
+	defaultServerAliveCountMax = 3
+	dialTimeout                = 15 * time.Second
+	knownHostsFile             = "~/.ssh/known_hosts"
+)
+
+// nativeTunnel serves a config in-process with golang.org/x/crypto/ssh
+// instead of shelling out to autossh
+type nativeTunnel struct {
+	conf      Config
+	onConnect func()
+	log       *tunnelLog
+	metrics   *tunnelMetrics
+
+	mu        sync.Mutex
+	client    *ssh.Client
+	hops      []*ssh.Client
+	listeners []net.Listener
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func newNativeTunnel(conf Config) *nativeTunnel {
+	return &nativeTunnel{
+		conf: conf,
+		done: make(chan struct{}),
+	}
+}
+
+// Run connects to the remote host, serves every forward and blocks until
+// the connection is lost or the tunnel is closed
+func (t *nativeTunnel) Run() error {
+	defer t.Close()
+
+	begin := time.Now()
+	client, err := t.dial()
+	if err != nil {
+		return err
+	}
+	t.metrics.setLatency(time.Since(begin))
+
+	for _, fw := range t.conf.forwards() {
+		fw := fw
+		ln, err := net.Listen("tcp", fw.local())
+		if err != nil {
+			return err
+		}
+		t.mu.Lock()
+		t.listeners = append(t.listeners, ln)
+		t.mu.Unlock()
+		go t.serve(ln, t.pipeTo(forwardKey{"local", fw.local()}, func() (net.Conn, error) {
+			return client.Dial("tcp", fw.remote())
+		}))
+	}
+
+	for _, fw := range t.conf.RemoteForwards {
+		fw := fw
+		ln, err := client.Listen("tcp", fw.remote())
+		if err != nil {
+			return fmt.Errorf("remote forward %s: %s", fw, err.Error())
+		}
+		t.mu.Lock()
+		t.listeners = append(t.listeners, ln)
+		t.mu.Unlock()
+		go t.serve(ln, t.pipeTo(forwardKey{"remote", fw.remote()}, func() (net.Conn, error) {
+			return net.DialTimeout("tcp", fw.local(), dialTimeout)
+		}))
+	}
+
+	for _, port := range t.conf.DynamicForwards {
+		listen := net.JoinHostPort(t.conf.LocalBindAddress, port)
+		ln, err := net.Listen("tcp", listen)
+		if err != nil {
+			return err
+		}
+		t.mu.Lock()
+		t.listeners = append(t.listeners, ln)
+		t.mu.Unlock()
+		fm := t.metrics.forward(forwardKey{"dynamic", listen})
+		go t.serve(ln, func(conn net.Conn) {
+			defer fm.open()()
+			serveSOCKS(countingConn{conn, &fm.upstream}, func(addr string) (net.Conn, error) {
+				target, err := client.Dial("tcp", addr)
+				if err != nil {
+					return nil, err
+				}
+				return countingConn{target, &fm.downstream}, nil
+			})
+		})
+	}
+
+	if t.onConnect != nil {
+		t.onConnect()
+	}
+
+	errc := make(chan error, 2)
+	go func() {
+		errc <- client.Wait()
+	}()
+	if t.conf.ServerAliveInterval > 0 {
+		go func() {
+			errc <- t.keepalive(client)
+		}()
+	}
+
+	select {
+	case err := <-errc:
+		if err == nil {
+			err = errors.New("connection closed")
+		}
+		return err
+	case <-t.done:
+		return nil
+	}
+}
+
+// Close stops listening and disconnects from the remote host
+func (t *nativeTunnel) Close() error {
+	t.closeOnce.Do(func() {
+		close(t.done)
+	})
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, ln := range t.listeners {
+		ln.Close()
+	}
+	t.listeners = nil
+	if t.client != nil {
+		t.client.Close()
+		t.client = nil
+	}
+	for i := len(t.hops) - 1; i >= 0; i-- {
+		t.hops[i].Close()
+	}
+	t.hops = nil
+	return nil
+}
+
+// dial connects to the remote host, through every jump host in order
+func (t *nativeTunnel) dial() (*ssh.Client, error) {
+	if len(t.conf.ProxyCommand) > 0 {
+		return nil, errors.New("ProxyCommand is not supported by the native backend")
+	}
+
+	var via *ssh.Client
+	for _, hop := range t.conf.JumpHosts {
+		identityFile := hop.IdentityFile
+		if len(identityFile) == 0 {
+			identityFile = t.conf.IdentityFile
+		}
+		config, err := clientConfig(t.conf, hop.user(), identityFile)
+		if err != nil {
+			return nil, err
+		}
+		client, err := dialVia(via, hop.address(), config)
+		if err != nil {
+			return nil, fmt.Errorf("jump host %s: %s", hop, err.Error())
+		}
+		t.mu.Lock()
+		t.hops = append(t.hops, client)
+		t.mu.Unlock()
+		via = client
+	}
+
+	config, err := clientConfig(t.conf, t.conf.RemoteUser, t.conf.IdentityFile)
+	if err != nil {
+		return nil, err
+	}
+	port := t.conf.RemotePort
+	if len(port) == 0 {
+		port = defaultSSHPort
+	}
+	client, err := dialVia(via, net.JoinHostPort(t.conf.RemoteHost, port), config)
+	if err != nil {
+		return nil, err
+	}
+	t.mu.Lock()
+	t.client = client
+	t.mu.Unlock()
+	return client, nil
+}
+
+// dialVia connects to addr directly, or through an already connected hop
+func dialVia(via *ssh.Client, addr string, config *ssh.ClientConfig) (*ssh.Client, error) {
+	if via == nil {
+		return ssh.Dial("tcp", addr, config)
+	}
+	conn, err := via.Dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	c, chans, reqs, err := ssh.NewClientConn(conn, addr, config)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return ssh.NewClient(c, chans, reqs), nil
+}
+
+func clientConfig(conf Config, user, identityFile string) (*ssh.ClientConfig, error) {
+	auth, err := authMethods(identityFile)
+	if err != nil {
+		return nil, err
+	}
+	hostKeyCallback, err := hostKeyCallback(conf)
+	if err != nil {
+		return nil, err
+	}
+	return &ssh.ClientConfig{
+		User:            user,
+		Auth:            auth,
+		HostKeyCallback: hostKeyCallback,
+		Timeout:         dialTimeout,
+	}, nil
+}
+
+// serve accepts connections on a listener and handles each one until the
+// listener is closed
+func (t *nativeTunnel) serve(ln net.Listener, handle func(conn net.Conn)) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			handle(conn)
+		}()
+	}
+}
+
+// pipeTo returns a handler that pipes a connection to the other end of a
+// forward
+func (t *nativeTunnel) pipeTo(key forwardKey, dial func() (net.Conn, error)) func(conn net.Conn) {
+	fm := t.metrics.forward(key)
+	return func(conn net.Conn) {
+		target, err := dial()
+		if err != nil {
+			t.log.Printf("forward from %s: %s", conn.RemoteAddr(), err.Error())
+			return
+		}
+		defer target.Close()
+		defer fm.open()()
+		pipe(countingConn{conn, &fm.upstream}, countingConn{target, &fm.downstream})
+	}
+}
+
+// keepalive does what ServerAliveInterval and ServerAliveCountMax do for ssh
+func (t *nativeTunnel) keepalive(client *ssh.Client) error {
+	interval := time.Duration(t.conf.ServerAliveInterval) * time.Second
+	countMax := t.conf.ServerAliveCountMax
+	if countMax <= 0 {
+		countMax = defaultServerAliveCountMax
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	missed := 0
+	for {
+		select {
+		case <-t.done:
+			return nil
+		case <-ticker.C:
+		}
+
+		reply := make(chan error, 1)
+		go func() {
+			_, _, err := client.SendRequest("keepalive@openssh.com", true, nil)
+			reply <- err
+		}()
+		select {
+		case err := <-reply:
+			if err != nil {
+				return err
+			}
+			missed = 0
+		case <-time.After(interval):
+			missed++
+			if missed >= countMax {
+				return fmt.Errorf("%s not responding", t.conf.RemoteHost)
+			}
+		}
+	}
+}
+
+// pipe copies data in both directions until one side is done
+func pipe(a, b net.Conn) {
+	done := make(chan struct{}, 2)
+	go func() {
+		io.Copy(a, b)
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(b, a)
+		done <- struct{}{}
+	}()
+	<-done
+}
+
+// defaultIdentityFiles are the keys ssh tries when no IdentityFile is given
+var defaultIdentityFiles = []string{"~/.ssh/id_ed25519", "~/.ssh/id_ecdsa", "~/.ssh/id_rsa"}
+
+// authMethods authenticates with an identity file, or like ssh with the
+// default ones that can be read without a passphrase, and with ssh-agent
+func authMethods(identityFile string) ([]ssh.AuthMethod, error) {
+	methods := []ssh.AuthMethod{}
+	if len(identityFile) > 0 {
+		key, err := ioutil.ReadFile(expandHome(identityFile))
+		if err != nil {
+			return nil, err
+		}
+		signer, err := ssh.ParsePrivateKey(key)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", identityFile, err.Error())
+		}
+		methods = append(methods, ssh.PublicKeys(signer))
+	} else {
+		signers := []ssh.Signer{}
+		for _, path := range defaultIdentityFiles {
+			key, err := ioutil.ReadFile(expandHome(path))
+			if err != nil {
+				continue
+			}
+			signer, err := ssh.ParsePrivateKey(key)
+			if err != nil {
+				continue
+			}
+			signers = append(signers, signer)
+		}
+		if len(signers) > 0 {
+			methods = append(methods, ssh.PublicKeys(signers...))
+		}
+	}
+	if sock := os.Getenv("SSH_AUTH_SOCK"); len(sock) > 0 {
+		conn, err := net.Dial("unix", sock)
+		if err == nil {
+			methods = append(methods, ssh.PublicKeysCallback(agent.NewClient(conn).Signers))
+		}
+	}
+	if len(methods) == 0 {
+		return nil, errors.New("no IdentityFile, no default key in ~/.ssh and no ssh-agent available")
+	}
+	return methods, nil
+}
+
+// hostKeyCallback checks host keys against ~/.ssh/known_hosts. accept-new
+// adds the keys of unknown hosts to it, and ask is treated like yes because
+// there is no one to ask
+func hostKeyCallback(conf Config) (ssh.HostKeyCallback, error) {
+	mode := strings.ToLower(conf.StrictHostKeyChecking)
+	switch mode {
+	case "no", "off":
+		return ssh.InsecureIgnoreHostKey(), nil
+	}
+
+	path := expandHome(knownHostsFile)
+	if mode == "accept-new" {
+		err := os.MkdirAll(filepath.Dir(path), 0700)
+		if err != nil {
+			return nil, err
+		}
+		file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY, 0600)
+		if err != nil {
+			return nil, err
+		}
+		file.Close()
+	} else if !fileExists(path) {
+		return nil, fmt.Errorf("%s does not exist, connect with ssh once or set StrictHostKeyChecking to accept-new", path)
+	}
+	check, err := knownhosts.New(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		err := check(hostname, remote, key)
+		keyErr, ok := err.(*knownhosts.KeyError)
+		switch {
+		case !ok:
+			return err
+		case len(keyErr.Want) > 0:
+			return fmt.Errorf("host key of %s does not match the one in %s", hostname, path)
+		case mode == "accept-new":
+			return addKnownHost(path, hostname, key)
+		default:
+			return fmt.Errorf("host key of %s is not in %s", hostname, path)
+		}
+	}, nil
+}
+
+// addKnownHost adds the key of a host to a known_hosts file
+func addKnownHost(path, hostname string, key ssh.PublicKey) error {
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(file, knownhosts.Line([]string{knownhosts.Normalize(hostname)}, key))
+	if err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// expandHome replaces a leading ~ with the user's home directory
+func expandHome(path string) string {
+	if path != "~" && !strings.HasPrefix(path, "~/") {
+		return path
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return path
+	}
+	return filepath.Join(home, path[1:])
+}
+
+// runTunnel keeps the named tunnel connected until the process is killed,
+// with its output going to the tunnel's log. It is what a tunnel started
+// without the daemon runs.
+func runTunnel(dataPath, configPath, name string) error {
+	conf, err := loadConfig(configPath, name)
+	if err != nil {
+		return err
+	}
+	err = checkConfig(conf)
+	if err != nil {
+		return err
+	}
+	log, err := openLog(dataPath, name)
+	if err != nil {
+		return err
+	}
+	defer log.Close()
+
+	if conf.Backend != backendNative {
+		// autossh does the reconnecting itself
+		log.Printf("starting autossh")
+		cmd := exec.Command("autossh", append([]string{"-M", "0", "-N"}, sshArgs(conf)...)...)
+		cmd.Stdout = log
+		cmd.Stderr = log
+		err := cmd.Run()
+		log.Printf("autossh exited: %v", err)
+		return err
+	}
+
+	return supervise(dataPath, conf, nil, log, func(connected func()) error {
+		tunnel := newNativeTunnel(conf)
+		tunnel.onConnect = connected
+		tunnel.log = log
+		return tunnel.Run()
+	})
+}
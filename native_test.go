@@ -0,0 +1,488 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// testServer is an in-process ssh server that accepts one key and serves
+// direct-tcpip channels and tcpip-forward requests like sshd does
+type testServer struct {
+	port string
+
+	mu    sync.Mutex
+	users []string
+	// mute stops the server from answering keepalives
+	mute bool
+}
+
+// muted reports whether keepalives go unanswered
+func (s *testServer) muted() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.mute
+}
+
+// logins returns the users that authenticated, in order
+func (s *testServer) logins() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string{}, s.users...)
+}
+
+func startTestServer(t *testing.T, authorized ssh.PublicKey) *testServer {
+	t.Helper()
+	_, hostKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostSigner, err := ssh.NewSignerFromKey(hostKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &testServer{}
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: func(meta ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if !bytes.Equal(key.Marshal(), authorized.Marshal()) {
+				return nil, io.EOF
+			}
+			s.mu.Lock()
+			s.users = append(s.users, meta.User())
+			s.mu.Unlock()
+			return nil, nil
+		},
+	}
+	config.AddHostKey(hostSigner)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	_, s.port, _ = net.SplitHostPort(ln.Addr().String())
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go s.serveConn(conn, config)
+		}
+	}()
+	return s
+}
+
+func (s *testServer) serveConn(conn net.Conn, config *ssh.ServerConfig) {
+	server, chans, reqs, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		return
+	}
+	defer server.Close()
+	go func() {
+		for req := range reqs {
+			if req.Type == "keepalive@openssh.com" && s.muted() {
+				continue
+			}
+			if req.Type != "tcpip-forward" {
+				req.Reply(req.Type == "keepalive@openssh.com", nil)
+				continue
+			}
+			var payload struct {
+				Addr string
+				Port uint32
+			}
+			ssh.Unmarshal(req.Payload, &payload)
+			ln, err := net.Listen("tcp", net.JoinHostPort(payload.Addr, strconv.Itoa(int(payload.Port))))
+			if err != nil {
+				req.Reply(false, nil)
+				continue
+			}
+			go func() {
+				server.Wait()
+				ln.Close()
+			}()
+			req.Reply(true, ssh.Marshal(struct{ Port uint32 }{payload.Port}))
+			go func() {
+				for {
+					conn, err := ln.Accept()
+					if err != nil {
+						return
+					}
+					ch, chReqs, err := server.OpenChannel("forwarded-tcpip", ssh.Marshal(struct {
+						Addr       string
+						Port       uint32
+						OriginAddr string
+						OriginPort uint32
+					}{payload.Addr, payload.Port, "127.0.0.1", 1}))
+					if err != nil {
+						conn.Close()
+						continue
+					}
+					go ssh.DiscardRequests(chReqs)
+					go pipeChannel(ch, conn)
+				}
+			}()
+		}
+	}()
+	for newChannel := range chans {
+		if newChannel.ChannelType() != "direct-tcpip" {
+			newChannel.Reject(ssh.UnknownChannelType, "only direct-tcpip")
+			continue
+		}
+		var payload struct {
+			Host       string
+			Port       uint32
+			OriginAddr string
+			OriginPort uint32
+		}
+		ssh.Unmarshal(newChannel.ExtraData(), &payload)
+		target, err := net.Dial("tcp", net.JoinHostPort(payload.Host, strconv.Itoa(int(payload.Port))))
+		if err != nil {
+			newChannel.Reject(ssh.ConnectionFailed, err.Error())
+			continue
+		}
+		ch, chReqs, err := newChannel.Accept()
+		if err != nil {
+			target.Close()
+			continue
+		}
+		go ssh.DiscardRequests(chReqs)
+		go pipeChannel(ch, target)
+	}
+}
+
+func pipeChannel(ch ssh.Channel, conn net.Conn) {
+	go func() {
+		io.Copy(ch, conn)
+		ch.CloseWrite()
+	}()
+	io.Copy(conn, ch)
+	conn.Close()
+}
+
+// writeTestKey writes a new key without a passphrase to path and returns
+// its public key
+func writeTestKey(t *testing.T, path string) ssh.PublicKey {
+	t.Helper()
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, err := ssh.MarshalPrivateKey(key, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(path, pem.EncodeToMemory(block), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer.PublicKey()
+}
+
+// startEcho runs a server that writes back whatever it reads and returns
+// its port
+func startEcho(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(conn, conn)
+				conn.Close()
+			}()
+		}
+	}()
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+	return port
+}
+
+func freePort(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+	return port
+}
+
+func checkEcho(t *testing.T, conn net.Conn) {
+	t.Helper()
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	_, err := conn.Write([]byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	reply := make([]byte, 5)
+	_, err = io.ReadFull(conn, reply)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(reply) != "hello" {
+		t.Fatalf("echo answered %q", reply)
+	}
+}
+
+func dialEcho(t *testing.T, addr string) {
+	t.Helper()
+	conn, err := net.DialTimeout("tcp", addr, 2*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	checkEcho(t, conn)
+}
+
+// nativeTestEnv is a key, a server that accepts it and a config for it
+type nativeTestEnv struct {
+	server  *testServer
+	keyFile string
+	conf    Config
+}
+
+func newNativeTestEnv(t *testing.T) nativeTestEnv {
+	t.Setenv("HOME", t.TempDir())
+	t.Setenv("SSH_AUTH_SOCK", "")
+	keyFile := filepath.Join(t.TempDir(), "id_test")
+	server := startTestServer(t, writeTestKey(t, keyFile))
+	conf := Config{
+		host: host{
+			RemoteUser: "tester",
+			RemoteHost: "127.0.0.1",
+			RemotePort: server.port,
+		},
+		IdentityFile:          keyFile,
+		StrictHostKeyChecking: "no",
+		LocalBindAddress:      "127.0.0.1",
+		Backend:               backendNative,
+	}
+	return nativeTestEnv{server, keyFile, conf}
+}
+
+// runNative starts a native tunnel and waits until it is connected
+func runNative(t *testing.T, conf Config) *nativeTunnel {
+	t.Helper()
+	tunnel := newNativeTunnel(conf)
+	connected := make(chan struct{})
+	tunnel.onConnect = func() { close(connected) }
+	errc := make(chan error, 1)
+	go func() {
+		errc <- tunnel.Run()
+	}()
+	select {
+	case <-connected:
+	case err := <-errc:
+		t.Fatalf("tunnel failed: %v", err)
+	case <-time.After(5 * time.Second):
+		tunnel.Close()
+		t.Fatal("tunnel didn't connect within 5s")
+	}
+	t.Cleanup(func() {
+		tunnel.Close()
+		<-errc
+	})
+	return tunnel
+}
+
+func TestNativeLocalForward(t *testing.T) {
+	env := newNativeTestEnv(t)
+	port := freePort(t)
+	env.conf.ForwardPorts = []forward{parseForward(":" + port + ":127.0.0.1:" + startEcho(t))}
+	runNative(t, env.conf)
+	dialEcho(t, net.JoinHostPort("127.0.0.1", port))
+	dialEcho(t, net.JoinHostPort("127.0.0.1", port))
+}
+
+func TestNativeRemoteForward(t *testing.T) {
+	env := newNativeTestEnv(t)
+	port := freePort(t)
+	env.conf.RemoteForwards = []remoteForward{{RemoteBindAddress: "127.0.0.1", RemotePort: port, LocalHost: "127.0.0.1", LocalPort: startEcho(t)}}
+	runNative(t, env.conf)
+	dialEcho(t, net.JoinHostPort("127.0.0.1", port))
+}
+
+func TestNativeSOCKS(t *testing.T) {
+	env := newNativeTestEnv(t)
+	port := freePort(t)
+	env.conf.DynamicForwards = []string{port}
+	runNative(t, env.conf)
+
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort("127.0.0.1", port), 2*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	conn.Write([]byte{5, 1, 0})
+	method := make([]byte, 2)
+	if _, err := io.ReadFull(conn, method); err != nil || method[1] != 0 {
+		t.Fatalf("no auth method: %v %v", method, err)
+	}
+	target, _ := strconv.Atoi(startEcho(t))
+	host := "localhost"
+	req := append([]byte{5, 1, 0, 3, byte(len(host))}, host...)
+	conn.Write(append(req, byte(target>>8), byte(target)))
+	reply := make([]byte, 10)
+	if _, err := io.ReadFull(conn, reply); err != nil || reply[1] != 0 {
+		t.Fatalf("connect failed: %v %v", reply, err)
+	}
+	checkEcho(t, conn)
+}
+
+func TestNativeJumpHosts(t *testing.T) {
+	env := newNativeTestEnv(t)
+	port := freePort(t)
+	env.conf.ForwardPorts = []forward{parseForward(":" + port + ":127.0.0.1:" + startEcho(t))}
+	// the second hop has no IdentityFile and uses the config's
+	env.conf.JumpHosts = []jumpHost{
+		{User: "first", Host: "127.0.0.1", Port: env.server.port, IdentityFile: env.keyFile},
+		{User: "second", Host: "127.0.0.1", Port: env.server.port},
+	}
+	tunnel := runNative(t, env.conf)
+	dialEcho(t, net.JoinHostPort("127.0.0.1", port))
+
+	tunnel.mu.Lock()
+	hops := len(tunnel.hops)
+	tunnel.mu.Unlock()
+	if hops != 2 {
+		t.Errorf("connected through %d hops, want 2", hops)
+	}
+	logins := env.server.logins()
+	if len(logins) != 3 || logins[0] != "first" || logins[1] != "second" || logins[2] != "tester" {
+		t.Errorf("logged in as %v, want [first second tester]", logins)
+	}
+}
+
+func TestNativeDefaultIdentity(t *testing.T) {
+	env := newNativeTestEnv(t)
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	err := os.Mkdir(filepath.Join(home, ".ssh"), 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// only a default key is authorized on this server
+	server := startTestServer(t, writeTestKey(t, filepath.Join(home, ".ssh", "id_ed25519")))
+	env.conf.RemotePort = server.port
+	env.conf.IdentityFile = ""
+	env.conf.JumpHosts = []jumpHost{{User: "hop", Host: "127.0.0.1", Port: server.port}}
+	runNative(t, env.conf)
+
+	if logins := server.logins(); len(logins) != 2 {
+		t.Errorf("logged in as %v, want [hop tester]", logins)
+	}
+}
+
+func TestNativeWrongKey(t *testing.T) {
+	env := newNativeTestEnv(t)
+	env.conf.IdentityFile = filepath.Join(t.TempDir(), "id_other")
+	writeTestKey(t, env.conf.IdentityFile)
+	err := newNativeTunnel(env.conf).Run()
+	if err == nil {
+		t.Fatal("connected with a key the server doesn't accept")
+	}
+}
+
+func TestNativeAcceptNew(t *testing.T) {
+	env := newNativeTestEnv(t)
+	env.conf.StrictHostKeyChecking = "yes"
+	err := newNativeTunnel(env.conf).Run()
+	if err == nil || !strings.Contains(err.Error(), "known_hosts does not exist") {
+		t.Fatalf("connected without a known_hosts file: %v", err)
+	}
+
+	// the first connection adds the host key and later ones check it
+	env.conf.StrictHostKeyChecking = "accept-new"
+	runNative(t, env.conf).Close()
+	knownHosts := filepath.Join(os.Getenv("HOME"), ".ssh", "known_hosts")
+	bt, err := ioutil.ReadFile(knownHosts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Split(strings.TrimSpace(string(bt)), "\n"); len(lines) != 1 || !strings.HasPrefix(lines[0], "[127.0.0.1]:"+env.server.port+" ") {
+		t.Fatalf("known_hosts is %q", bt)
+	}
+	env.conf.StrictHostKeyChecking = "yes"
+	runNative(t, env.conf)
+
+	// another server on the same address has a different host key
+	other := startTestServer(t, writeTestKey(t, env.keyFile))
+	changed := strings.Replace(string(bt), env.server.port, other.port, 1)
+	err = ioutil.WriteFile(knownHosts, []byte(changed), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	env.conf.RemotePort = other.port
+	for _, mode := range []string{"yes", "accept-new"} {
+		env.conf.StrictHostKeyChecking = mode
+		err = newNativeTunnel(env.conf).Run()
+		if err == nil || !strings.Contains(err.Error(), "does not match") {
+			t.Errorf("connected to a host with a changed key with %s: %v", mode, err)
+		}
+	}
+}
+
+func TestNativeKeepalive(t *testing.T) {
+	env := newNativeTestEnv(t)
+	env.conf.ServerAliveInterval = 1
+	env.conf.ServerAliveCountMax = 2
+	tunnel := newNativeTunnel(env.conf)
+	connected := make(chan struct{})
+	tunnel.onConnect = func() { close(connected) }
+	errc := make(chan error, 1)
+	go func() {
+		errc <- tunnel.Run()
+	}()
+	defer tunnel.Close()
+	select {
+	case <-connected:
+	case err := <-errc:
+		t.Fatalf("tunnel failed: %v", err)
+	}
+
+	// answered keepalives keep the tunnel up
+	select {
+	case err := <-errc:
+		t.Fatalf("tunnel dropped while the server answered: %v", err)
+	case <-time.After(2500 * time.Millisecond):
+	}
+
+	env.server.mu.Lock()
+	env.server.mute = true
+	env.server.mu.Unlock()
+	select {
+	case err := <-errc:
+		if err == nil || !strings.Contains(err.Error(), "not responding") {
+			t.Errorf("tunnel dropped with %v, want not responding", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Error("tunnel didn't drop within 10s of the server not answering")
+	}
+}
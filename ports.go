@@ -0,0 +1,104 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os/exec"
+	"strings"
+	"syscall"
+)
+
+// portConflict is a local endpoint of a tunnel that can't be listened on
+type portConflict struct {
+	Endpoint string
+	Owner    string
+	Err      error
+}
+
+func (c portConflict) String() string {
+	if !errors.Is(c.Err, syscall.EADDRINUSE) {
+		return c.Err.Error()
+	}
+	if len(c.Owner) == 0 {
+		return c.Endpoint + " is already in use"
+	}
+	return c.Endpoint + " is already in use by " + c.Owner
+}
+
+// localEndpoints returns every address a tunnel listens on locally
+func localEndpoints(conf Config) []string {
+	endpoints := []string{}
+	for _, fw := range conf.forwards() {
+		endpoints = append(endpoints, fw.local())
+	}
+	for _, port := range conf.DynamicForwards {
+		endpoints = append(endpoints, net.JoinHostPort(conf.LocalBindAddress, port))
+	}
+	return endpoints
+}
+
+// checkPorts tries to listen on every local endpoint of a tunnel that is
+// not running and returns the ones that are taken
+func checkPorts(configPath string, conf Config) []portConflict {
+	conflicts := []portConflict{}
+	for _, endpoint := range localEndpoints(conf) {
+		ln, err := net.Listen("tcp", endpoint)
+		if err == nil {
+			ln.Close()
+			continue
+		}
+		conflict := portConflict{Endpoint: endpoint, Err: err}
+		if errors.Is(err, syscall.EADDRINUSE) {
+			conflict.Owner = portOwner(configPath, conf.Name, endpoint)
+		}
+		conflicts = append(conflicts, conflict)
+	}
+	return conflicts
+}
+
+// checkPortsError returns the first conflict of a tunnel as an error
+func checkPortsError(configPath string, conf Config) error {
+	conflicts := checkPorts(configPath, conf)
+	if len(conflicts) > 0 {
+		return fmt.Errorf("%s: %s", conf.Name, conflicts[0])
+	}
+	return nil
+}
+
+// portOwner names another config that forwards the same endpoint, or the
+// process listening on it
+func portOwner(configPath, name, endpoint string) string {
+	names, _ := configNames(configPath)
+	for _, other := range names {
+		if other == name {
+			continue
+		}
+		conf, err := loadConfig(configPath, other)
+		if err != nil {
+			continue
+		}
+		if contains(localEndpoints(conf), endpoint) {
+			return "config " + other
+		}
+	}
+
+	// lsof -F prints one field per line, p for the pid and c for the command
+	out, err := exec.Command("lsof", "-nP", "-iTCP@"+endpoint, "-sTCP:LISTEN", "-Fpc").Output()
+	if err != nil {
+		return ""
+	}
+	pid, command := "", ""
+	for _, line := range strings.Split(string(out), "\n") {
+		switch {
+		case strings.HasPrefix(line, "p") && len(pid) == 0:
+			pid = line[1:]
+		case strings.HasPrefix(line, "c") && len(command) == 0:
+			command = line[1:]
+		}
+	}
+	if len(pid) == 0 {
+		return ""
+	}
+	return fmt.Sprintf("%s (pid %s)", command, pid)
+}
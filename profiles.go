@@ -0,0 +1,168 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	defaultsFile  = "defaults.yml"
+	profileFolder = "profiles"
+)
+
+// document is a config, profile or defaults file as it is written, before
+// anything is merged into it
+type document map[interface{}]interface{}
+
+func readDocument(path string) (document, error) {
+	bt, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	doc := document{}
+	err = yaml.Unmarshal(bt, &doc)
+	if err != nil {
+		return nil, err
+	}
+	return doc, nil
+}
+
+// resolveDocument migrates a config, the profiles it extends and
+// defaults.yml to configVersion and merges the config over the profiles and
+// those over defaults.yml, so whatever is closer to the config wins. Mappings are
+// merged key by key, anything else, lists too, replaces what is below it.
+// It also returns the files that were merged, from the bottom up.
+func resolveDocument(configPath string, doc document) (document, []string, error) {
+	dataPath := filepath.Dir(configPath)
+	if _, err := migrateDocument(doc); err != nil {
+		return nil, nil, err
+	}
+	layers := []document{doc}
+	sources := []string{}
+
+	extended := []string{}
+	for layer := doc; layer["Extends"] != nil; {
+		name, ok := layer["Extends"].(string)
+		if !ok || len(name) == 0 || strings.ContainsAny(name, "/ ") {
+			return nil, nil, fmt.Errorf("Extends: %v is not a valid profile name", layer["Extends"])
+		}
+		if contains(extended, name) {
+			return nil, nil, fmt.Errorf("profile cycle %s", strings.Join(append(extended, name), " → "))
+		}
+		extended = append(extended, name)
+		path := filepath.Join(profileFolder, name+".yml")
+		profile, err := readDocument(filepath.Join(dataPath, path))
+		if os.IsNotExist(err) {
+			return nil, nil, fmt.Errorf("profile %s does not exist", name)
+		}
+		if err == nil {
+			_, err = migrateDocument(profile)
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("profile %s: %s", name, err.Error())
+		}
+		layers = append(layers, profile)
+		sources = append([]string{path}, sources...)
+		layer = profile
+	}
+
+	defaults, err := readDocument(filepath.Join(dataPath, defaultsFile))
+	if err == nil {
+		_, err = migrateDocument(defaults)
+	}
+	switch {
+	case err == nil:
+		layers = append(layers, defaults)
+		sources = append([]string{defaultsFile}, sources...)
+	case !os.IsNotExist(err):
+		return nil, nil, fmt.Errorf("%s: %s", defaultsFile, err.Error())
+	}
+
+	merged := document{}
+	for i := len(layers) - 1; i >= 0; i-- {
+		merged = mergeDocuments(merged, layers[i])
+	}
+	delete(merged, "Extends")
+	return merged, sources, nil
+}
+
+// mergeDocuments returns base with over written on top of it
+func mergeDocuments(base, over document) document {
+	merged := document{}
+	for key, value := range base {
+		merged[key] = value
+	}
+	for key, value := range over {
+		baseMap, baseOK := toDocument(merged[key])
+		overMap, overOK := toDocument(value)
+		if baseOK && overOK {
+			merged[key] = mergeDocuments(baseMap, overMap)
+			continue
+		}
+		merged[key] = value
+	}
+	return merged
+}
+
+// toDocument returns a mapping as a document, yaml decodes the ones nested
+// in a document as documents too
+func toDocument(value interface{}) (document, bool) {
+	switch m := value.(type) {
+	case document:
+		return m, true
+	case map[interface{}]interface{}:
+		return document(m), true
+	}
+	return nil, false
+}
+
+// runShow prints a config as it is written, or with -resolved as it is
+// used, with defaults.yml, its profiles and variables applied
+func runShow(configPath string, args []string) error {
+	flags := flag.NewFlagSet("show", flag.ContinueOnError)
+	resolved := flags.Bool("resolved", false, "print the config with everything it inherits merged in")
+	err := flags.Parse(args)
+	if err != nil {
+		return usageError("sshtunnel show <name> [-resolved]")
+	}
+	name := flags.Arg(0)
+	if flags.NArg() > 1 {
+		err = flags.Parse(flags.Args()[1:])
+		if err != nil {
+			return usageError("sshtunnel show <name> [-resolved]")
+		}
+	}
+	if len(name) == 0 {
+		return usageError("sshtunnel show <name> [-resolved]")
+	}
+
+	if !*resolved {
+		bt, err := ioutil.ReadFile(configPath + "/" + name + ".yml")
+		if os.IsNotExist(err) {
+			return fmt.Errorf("%s does not exist", name)
+		}
+		if err != nil {
+			return err
+		}
+		fmt.Print(string(bt))
+		return nil
+	}
+
+	conf, sources, err := resolveConfig(configPath, name)
+	if err != nil {
+		return err
+	}
+	bt, err := yaml.Marshal(conf)
+	if err != nil {
+		return err
+	}
+	sources = append(sources, filepath.Join(configFolder, name+".yml"))
+	fmt.Printf("# %s\n%s", strings.Join(sources, " < "), string(bt))
+	return nil
+}
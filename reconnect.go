@@ -0,0 +1,241 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	defaultInitialDelay = time.Second
+	defaultMaxDelay     = 5 * time.Minute
+	defaultJitter       = 0.2
+	// a connection that stayed up this long resets the backoff
+	stableConnection = 30 * time.Second
+)
+
+// backoff is how a supervised or native tunnel waits between connection
+// attempts. The delay doubles after every failed attempt up to MaxDelay, and
+// a tunnel gives up after MaxAttempts failures in a row unless it is 0.
+type backoff struct {
+	InitialDelay time.Duration `yaml:"InitialDelay,omitempty"`
+	MaxDelay     time.Duration `yaml:"MaxDelay,omitempty"`
+	Jitter       *float64      `yaml:"Jitter,omitempty"`
+	MaxAttempts  int           `yaml:"MaxAttempts,omitempty"`
+}
+
+func (b backoff) withDefaults() backoff {
+	if b.InitialDelay == 0 {
+		b.InitialDelay = defaultInitialDelay
+	}
+	if b.MaxDelay == 0 {
+		b.MaxDelay = defaultMaxDelay
+	}
+	// Jitter: 0 turns jitter off, so only a missing one is defaulted
+	if b.Jitter == nil {
+		jitter := defaultJitter
+		b.Jitter = &jitter
+	}
+	return b
+}
+
+// delay returns how long to wait after the given number of failed attempts,
+// randomly spread by up to Jitter of itself in either direction
+func (b backoff) delay(attempt int) time.Duration {
+	d := b.InitialDelay
+	for i := 1; i < attempt && d < b.MaxDelay; i++ {
+		d *= 2
+	}
+	if d > b.MaxDelay {
+		d = b.MaxDelay
+	}
+	spread := 0.0
+	if b.Jitter != nil {
+		spread = float64(d) * *b.Jitter
+	}
+	return d + time.Duration(spread*(2*rand.Float64()-1))
+}
+
+func (b backoff) validate() []problem {
+	problems := []problem{}
+	if b.InitialDelay < 0 {
+		problems = append(problems, problem{"Reconnect.InitialDelay", "must not be negative"})
+	}
+	if b.MaxDelay < 0 {
+		problems = append(problems, problem{"Reconnect.MaxDelay", "must not be negative"})
+	} else if b.MaxDelay > 0 && b.MaxDelay < b.InitialDelay {
+		problems = append(problems, problem{"Reconnect.MaxDelay", "must not be less than InitialDelay"})
+	}
+	if b.Jitter != nil && (*b.Jitter < 0 || *b.Jitter > 1) {
+		problems = append(problems, problem{"Reconnect.Jitter", "must be between 0 and 1"})
+	}
+	if b.MaxAttempts < 0 {
+		problems = append(problems, problem{"Reconnect.MaxAttempts", "must not be negative"})
+	}
+	return problems
+}
+
+const (
+	historyFolder = "history"
+	maxHistory    = 100
+	historyWindow = 24 * time.Hour
+)
+
+const (
+	eventConnected    = "connected"
+	eventDisconnected = "disconnected"
+	eventFailed       = "failed"
+	eventGaveUp       = "gave up"
+)
+
+// event is a connect or disconnect of a tunnel
+type event struct {
+	Time   time.Time `json:"time"`
+	Event  string    `json:"event"`
+	Reason string    `json:"reason,omitempty"`
+}
+
+func historyPath(dataPath, name string) string {
+	return dataPath + "/" + historyFolder + "/" + name + ".json"
+}
+
+func readHistory(dataPath, name string) ([]event, error) {
+	events := []event{}
+	bt, err := ioutil.ReadFile(historyPath(dataPath, name))
+	if err != nil {
+		return events, err
+	}
+	err = json.Unmarshal(bt, &events)
+	return events, err
+}
+
+// appendHistory records an event, keeping only the latest maxHistory
+func appendHistory(dataPath, name, kind, reason string) error {
+	err := os.MkdirAll(dataPath+"/"+historyFolder, os.ModePerm)
+	if err != nil {
+		return err
+	}
+	events, _ := readHistory(dataPath, name)
+	events = append(events, event{Time: time.Now(), Event: kind, Reason: reason})
+	if len(events) > maxHistory {
+		events = events[len(events)-maxHistory:]
+	}
+	bt, err := json.MarshalIndent(events, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(historyPath(dataPath, name), bt, 0644)
+}
+
+// historySummary tells how often a tunnel dropped and how often it failed to
+// connect in the last historyWindow, and why it did the last time
+func historySummary(events []event) string {
+	since := time.Now().Add(-historyWindow)
+	dropped, failed := 0, 0
+	var last event
+	for _, ev := range events {
+		if ev.Time.Before(since) {
+			continue
+		}
+		switch ev.Event {
+		case eventDisconnected, eventFailed, eventGaveUp:
+			if ev.Reason == reasonStopped {
+				continue
+			}
+			switch ev.Event {
+			case eventDisconnected:
+				dropped++
+			case eventFailed:
+				failed++
+			}
+			last = ev
+		}
+	}
+	counts := []string{}
+	if dropped > 0 {
+		counts = append(counts, "dropped "+timesString(dropped))
+	}
+	if failed > 0 {
+		counts = append(counts, "failed to connect "+timesString(failed))
+	}
+	parts := []string{}
+	if len(counts) > 0 {
+		parts = append(parts, fmt.Sprintf("%s in %dh", strings.Join(counts, ", "), int(historyWindow.Hours())))
+	}
+	if len(last.Reason) > 0 {
+		parts = append(parts, fmt.Sprintf("%s %s: %s", last.Event, last.Time.Format("15:04"), last.Reason))
+	}
+	return strings.Join(parts, ", ")
+}
+
+func timesString(n int) string {
+	if n == 1 {
+		return "1 time"
+	}
+	return fmt.Sprintf("%d times", n)
+}
+
+const reasonStopped = "stopped"
+
+// supervise keeps a tunnel connected until stop is closed. connect makes one
+// attempt and blocks until it ends, calling connected once it is up. Every
+// attempt is recorded in the tunnel's history and log, and an error is
+// returned when the tunnel gives up.
+func supervise(dataPath string, conf Config, stop <-chan struct{}, log *tunnelLog, connect func(connected func()) error) error {
+	b := conf.Reconnect.withDefaults()
+	attempt := 0
+	for {
+		var up time.Time
+		log.Printf("connecting to %s", conf.RemoteHost)
+		err := connect(func() {
+			up = time.Now()
+			log.Printf("connected")
+			appendHistory(dataPath, conf.Name, eventConnected, "")
+		})
+
+		reason := "connection closed"
+		if err != nil {
+			reason = err.Error()
+		}
+		select {
+		case <-stop:
+			reason = reasonStopped
+		default:
+		}
+		if up.IsZero() {
+			if reason == reasonStopped {
+				return nil
+			}
+			log.Printf("failed to connect: %s", reason)
+			appendHistory(dataPath, conf.Name, eventFailed, reason)
+		} else {
+			log.Printf("disconnected: %s", reason)
+			appendHistory(dataPath, conf.Name, eventDisconnected, reason)
+			if time.Since(up) >= stableConnection {
+				attempt = 0
+			}
+		}
+		if reason == reasonStopped {
+			return nil
+		}
+
+		attempt++
+		if b.MaxAttempts > 0 && attempt >= b.MaxAttempts {
+			err = fmt.Errorf("gave up after %d attempts: %s", attempt, reason)
+			log.Printf("%s", err.Error())
+			appendHistory(dataPath, conf.Name, eventGaveUp, reason)
+			return err
+		}
+		delay := b.delay(attempt)
+		log.Printf("reconnecting in %s", delay.Round(100*time.Millisecond))
+		select {
+		case <-stop:
+			return nil
+		case <-time.After(delay):
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+)
+
+// SOCKS5 as described in RFC 1928, without authentication and with the
+// CONNECT command only
+const (
+	socksVersion         = 5
+	socksNoAuth          = 0
+	socksNoAcceptable    = 0xff
+	socksConnect         = 1
+	socksAddrIPv4        = 1
+	socksAddrDomain      = 3
+	socksAddrIPv6        = 4
+	socksSucceeded       = 0
+	socksHostUnreachable = 4
+	socksCmdUnsupported  = 7
+	socksAddrUnsupported = 8
+)
+
+// serveSOCKS reads a SOCKS5 CONNECT request from conn, dials the requested
+// address and pipes the connection to it
+func serveSOCKS(conn net.Conn, dial func(addr string) (net.Conn, error)) error {
+	buf := make([]byte, 256)
+
+	// version and authentication methods
+	if _, err := io.ReadFull(conn, buf[:2]); err != nil {
+		return err
+	}
+	if buf[0] != socksVersion {
+		return errors.New("socks: unsupported version")
+	}
+	methods := buf[1]
+	if _, err := io.ReadFull(conn, buf[:methods]); err != nil {
+		return err
+	}
+	noAuth := false
+	for _, method := range buf[:methods] {
+		if method == socksNoAuth {
+			noAuth = true
+		}
+	}
+	if !noAuth {
+		conn.Write([]byte{socksVersion, socksNoAcceptable})
+		return errors.New("socks: no acceptable authentication method")
+	}
+	if _, err := conn.Write([]byte{socksVersion, socksNoAuth}); err != nil {
+		return err
+	}
+
+	// request
+	if _, err := io.ReadFull(conn, buf[:4]); err != nil {
+		return err
+	}
+	if buf[1] != socksConnect {
+		socksReply(conn, socksCmdUnsupported)
+		return errors.New("socks: unsupported command")
+	}
+	var host string
+	switch buf[3] {
+	case socksAddrIPv4:
+		if _, err := io.ReadFull(conn, buf[:net.IPv4len]); err != nil {
+			return err
+		}
+		host = net.IP(buf[:net.IPv4len]).String()
+	case socksAddrIPv6:
+		if _, err := io.ReadFull(conn, buf[:net.IPv6len]); err != nil {
+			return err
+		}
+		host = net.IP(buf[:net.IPv6len]).String()
+	case socksAddrDomain:
+		if _, err := io.ReadFull(conn, buf[:1]); err != nil {
+			return err
+		}
+		length := buf[0]
+		if _, err := io.ReadFull(conn, buf[:length]); err != nil {
+			return err
+		}
+		host = string(buf[:length])
+	default:
+		socksReply(conn, socksAddrUnsupported)
+		return errors.New("socks: unsupported address type")
+	}
+	if _, err := io.ReadFull(conn, buf[:2]); err != nil {
+		return err
+	}
+	port := binary.BigEndian.Uint16(buf[:2])
+
+	target, err := dial(net.JoinHostPort(host, strconv.Itoa(int(port))))
+	if err != nil {
+		socksReply(conn, socksHostUnreachable)
+		return err
+	}
+	defer target.Close()
+	if err := socksReply(conn, socksSucceeded); err != nil {
+		return err
+	}
+	pipe(conn, target)
+	return nil
+}
+
+// socksReply answers a request, the bound address is not known through ssh
+// so it is always reported as 0.0.0.0:0
+func socksReply(conn net.Conn, status byte) error {
+	_, err := conn.Write([]byte{socksVersion, status, 0, socksAddrIPv4, 0, 0, 0, 0, 0, 0})
+	return err
+}
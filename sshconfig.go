@@ -0,0 +1,530 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	defaultSSHConfig = "~/.ssh/config"
+	maxIncludeDepth  = 16
+)
+
+// sshOption is a single keyword and its arguments from an ssh_config file
+type sshOption struct {
+	Keyword string
+	Args    []string
+}
+
+// sshBlock is a Host block from an ssh_config file. Match blocks are kept
+// with no patterns so they never apply.
+type sshBlock struct {
+	Patterns []string
+	Match    bool
+	Options  []sshOption
+}
+
+// cumulative keywords can be given more than once and every value is used
+var cumulativeKeywords = map[string]bool{
+	"identityfile":   true,
+	"localforward":   true,
+	"remoteforward":  true,
+	"dynamicforward": true,
+}
+
+// parseSSHConfig reads an ssh_config file and every file it includes
+func parseSSHConfig(path string) ([]sshBlock, error) {
+	blocks := []sshBlock{{Patterns: []string{"*"}}}
+	err := readSSHConfig(path, 0, &blocks)
+	return blocks, err
+}
+
+func readSSHConfig(path string, depth int, blocks *[]sshBlock) error {
+	if depth > maxIncludeDepth {
+		return fmt.Errorf("%s: too many nested includes", path)
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		keyword, args := splitSSHConfigLine(scanner.Text())
+		if len(keyword) == 0 {
+			continue
+		}
+		current := &(*blocks)[len(*blocks)-1]
+		switch keyword {
+		case "host":
+			*blocks = append(*blocks, sshBlock{Patterns: args})
+		case "match":
+			*blocks = append(*blocks, sshBlock{Match: true})
+		case "include":
+			for _, pattern := range args {
+				pattern = expandHome(pattern)
+				if !filepath.IsAbs(pattern) {
+					pattern = filepath.Join(expandHome("~/.ssh"), pattern)
+				}
+				matches, err := filepath.Glob(pattern)
+				if err != nil {
+					return err
+				}
+				for _, match := range matches {
+					err = readSSHConfig(match, depth+1, blocks)
+					if err != nil {
+						return err
+					}
+				}
+			}
+		default:
+			current.Options = append(current.Options, sshOption{Keyword: keyword, Args: args})
+		}
+	}
+	return scanner.Err()
+}
+
+// splitSSHConfigLine returns the lowercased keyword and the arguments of a
+// line, keywords may be separated from their arguments by = and arguments
+// may be double quoted
+func splitSSHConfigLine(line string) (string, []string) {
+	line = strings.TrimSpace(line)
+	if len(line) == 0 || strings.HasPrefix(line, "#") {
+		return "", nil
+	}
+	end := strings.IndexAny(line, " \t=")
+	if end < 0 {
+		return strings.ToLower(line), nil
+	}
+	keyword := strings.ToLower(line[:end])
+	rest := strings.TrimLeft(line[end:], " \t")
+	rest = strings.TrimPrefix(rest, "=")
+
+	args := []string{}
+	arg := ""
+	inArg, quoted := false, false
+	for _, r := range rest {
+		switch {
+		case r == '"':
+			quoted = !quoted
+			inArg = true
+		case (r == ' ' || r == '\t') && !quoted:
+			if inArg {
+				args = append(args, arg)
+				arg, inArg = "", false
+			}
+		default:
+			arg += string(r)
+			inArg = true
+		}
+	}
+	if inArg {
+		args = append(args, arg)
+	}
+	return keyword, args
+}
+
+// matchHostPatterns reports if a host matches a Host line, a negated
+// pattern that matches always wins
+func matchHostPatterns(patterns []string, host string) bool {
+	matched := false
+	for _, pattern := range patterns {
+		if strings.HasPrefix(pattern, "!") {
+			if wildcardMatch(pattern[1:], host) {
+				return false
+			}
+			continue
+		}
+		if wildcardMatch(pattern, host) {
+			matched = true
+		}
+	}
+	return matched
+}
+
+// wildcardMatch matches ssh_config patterns where * is any sequence and ?
+// is any single character
+func wildcardMatch(pattern, str string) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			for i := 0; i <= len(str); i++ {
+				if wildcardMatch(pattern[1:], str[i:]) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if len(str) == 0 {
+				return false
+			}
+		default:
+			if len(str) == 0 || !strings.EqualFold(pattern[:1], str[:1]) {
+				return false
+			}
+		}
+		pattern, str = pattern[1:], str[1:]
+	}
+	return len(str) == 0
+}
+
+// sshHostAliases lists every host named in a Host line without wildcards
+func sshHostAliases(blocks []sshBlock) []string {
+	seen := map[string]bool{}
+	aliases := []string{}
+	for _, block := range blocks {
+		for _, pattern := range block.Patterns {
+			if strings.ContainsAny(pattern, "*?!") || seen[pattern] {
+				continue
+			}
+			seen[pattern] = true
+			aliases = append(aliases, pattern)
+		}
+	}
+	return aliases
+}
+
+// resolveSSHHost returns the options that apply to a host. Like ssh, the
+// first value of a keyword wins unless the keyword is cumulative.
+func resolveSSHHost(blocks []sshBlock, host string) []sshOption {
+	options := []sshOption{}
+	seen := map[string]bool{}
+	for _, block := range blocks {
+		if block.Match || !matchHostPatterns(block.Patterns, host) {
+			continue
+		}
+		for _, option := range block.Options {
+			if seen[option.Keyword] && !cumulativeKeywords[option.Keyword] {
+				continue
+			}
+			seen[option.Keyword] = true
+			options = append(options, option)
+		}
+	}
+	return options
+}
+
+// configFromSSHOptions maps ssh options onto a Config and returns the
+// options it could not map
+func configFromSSHOptions(host, bindAddress string, options []sshOption) (Config, []string) {
+	conf := Config{LocalBindAddress: bindAddress}
+	conf.RemoteHost = host
+	unmapped := []string{}
+	for _, option := range options {
+		if len(option.Args) == 0 {
+			continue
+		}
+		arg := option.Args[0]
+		mapped := true
+		switch option.Keyword {
+		case "hostname":
+			conf.RemoteHost = strings.Replace(arg, "%h", host, -1)
+		case "user":
+			conf.RemoteUser = arg
+		case "port":
+			conf.RemotePort = arg
+		case "identityfile":
+			if len(conf.IdentityFile) == 0 {
+				conf.IdentityFile = arg
+			} else {
+				mapped = false
+			}
+		case "proxycommand":
+			if arg != "none" {
+				conf.ProxyCommand = strings.Join(option.Args, " ")
+			}
+		case "proxyjump":
+			if arg != "none" {
+				conf.JumpHosts = parseJumpHosts(arg)
+			}
+		case "serveraliveinterval":
+			conf.ServerAliveInterval, _ = strconv.Atoi(arg)
+		case "serveralivecountmax":
+			conf.ServerAliveCountMax, _ = strconv.Atoi(arg)
+		case "stricthostkeychecking":
+			conf.StrictHostKeyChecking = arg
+		case "localforward":
+			mapped = len(option.Args) == 2
+			if mapped {
+				bind, port := splitBindPort(arg)
+				remoteHost, remotePort := splitBindPort(option.Args[1])
+				fw := forward{LocalPort: port, RemoteHost: remoteHost, RemotePort: remotePort}
+				if bind != bindAddress {
+					fw.BindAddress = bind
+				}
+				conf.ForwardPorts = append(conf.ForwardPorts, fw)
+			}
+		case "remoteforward":
+			mapped = len(option.Args) == 2
+			if mapped {
+				bind, port := splitBindPort(arg)
+				local := strings.SplitN(option.Args[1], ":", 2)
+				if len(local) != 2 {
+					mapped = false
+					break
+				}
+				conf.RemoteForwards = append(conf.RemoteForwards, remoteForward{
+					RemoteBindAddress: bind,
+					RemotePort:        port,
+					LocalHost:         local[0],
+					LocalPort:         local[1],
+				})
+			}
+		case "dynamicforward":
+			bind, port := splitBindPort(arg)
+			if len(bind) > 0 && bind != bindAddress {
+				mapped = false
+				break
+			}
+			conf.DynamicForwards = append(conf.DynamicForwards, port)
+		default:
+			mapped = false
+		}
+		if !mapped {
+			unmapped = append(unmapped, option.Keyword+" "+strings.Join(option.Args, " "))
+		}
+	}
+	if len(conf.RemoteUser) == 0 {
+		conf.RemoteUser = localUser()
+	}
+	return conf, unmapped
+}
+
+// splitBindPort splits a [bind_address:]port forward argument
+func splitBindPort(arg string) (string, string) {
+	i := strings.LastIndex(arg, ":")
+	if i < 0 {
+		return "", arg
+	}
+	return arg[:i], arg[i+1:]
+}
+
+// parseJumpHosts parses a ProxyJump value such as user@host:port,host2
+func parseJumpHosts(spec string) []jumpHost {
+	hops := []jumpHost{}
+	for _, dest := range strings.Split(spec, ",") {
+		hop := jumpHost{}
+		if i := strings.LastIndex(dest, "@"); i >= 0 {
+			hop.User = dest[:i]
+			dest = dest[i+1:]
+		}
+		if i := strings.LastIndex(dest, ":"); i >= 0 {
+			hop.Port = dest[i+1:]
+			dest = dest[:i]
+		}
+		hop.Host = dest
+		hops = append(hops, hop)
+	}
+	return hops
+}
+
+// writeConfig saves a config as conf/<name>.yml
+func writeConfig(configPath string, conf Config) error {
+	conf.Version = configVersion
+	bt, err := yaml.Marshal(conf)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(configPath+"/"+conf.Name+".yml", bt, 0644)
+}
+
+// runImport writes a config for every named host, or every host alias, in
+// an ssh_config file
+func runImport(configPath string, args []string) error {
+	flags := flag.NewFlagSet("import-ssh-config", flag.ContinueOnError)
+	path := flags.String("f", defaultSSHConfig, "ssh_config file to import from")
+	bindAddress := flags.String("bind", "127.0.0.1", "LocalBindAddress of the imported configs")
+	force := flags.Bool("force", false, "overwrite existing configs")
+	err := flags.Parse(args)
+	if err != nil {
+		return usageError("sshtunnel import-ssh-config [-f file] [-bind address] [-force] [host...]")
+	}
+
+	blocks, err := parseSSHConfig(expandHome(*path))
+	if err != nil {
+		return err
+	}
+	hosts := flags.Args()
+	if len(hosts) == 0 {
+		hosts = sshHostAliases(blocks)
+	}
+	for _, block := range blocks {
+		if block.Match {
+			fmt.Println("Match blocks are not evaluated")
+			break
+		}
+	}
+
+	for _, host := range hosts {
+		conf, unmapped := configFromSSHOptions(host, *bindAddress, resolveSSHHost(blocks, host))
+		conf.Name = host
+
+		if _, err := os.Stat(configPath + "/" + host + ".yml"); err == nil && !*force {
+			fmt.Printf("%s: skipped, config already exists\n", host)
+			continue
+		}
+		err = writeConfig(configPath, conf)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%s: imported\n", host)
+		for _, option := range unmapped {
+			fmt.Printf("%s: not mapped: %s\n", host, option)
+		}
+	}
+	return nil
+}
+
+const (
+	managedIncludeFile   = "~/.ssh/sshtunnel_config"
+	managedIncludeHeader = "# Managed by sshtunnel export-ssh-config, changes will be overwritten\n"
+)
+
+// renderSSHHost renders a config as an ssh_config Host block, so the same
+// tunnel can be opened with ssh -N <name>. A config with a forward that
+// can't be used is not rendered rather than rendered without it
+func renderSSHHost(conf Config) (string, error) {
+	lines := []string{"Host " + conf.Name}
+	add := func(keyword, value string) {
+		if len(value) > 0 {
+			lines = append(lines, "    "+keyword+" "+value)
+		}
+	}
+	add("HostName", conf.RemoteHost)
+	add("User", conf.RemoteUser)
+	add("Port", conf.RemotePort)
+	add("IdentityFile", sshConfigQuote(conf.IdentityFile))
+	if conf.ServerAliveInterval > 0 {
+		add("ServerAliveInterval", strconv.Itoa(conf.ServerAliveInterval))
+	}
+	if conf.ServerAliveCountMax > 0 {
+		add("ServerAliveCountMax", strconv.Itoa(conf.ServerAliveCountMax))
+	}
+	add("StrictHostKeyChecking", conf.StrictHostKeyChecking)
+	// ProxyCommand takes the rest of the line as it is
+	add("ProxyCommand", conf.ProxyCommand)
+	if len(conf.JumpHosts) > 0 {
+		args := jumpArgs(conf.JumpHosts)
+		if args[0] == "-J" {
+			add("ProxyJump", args[1])
+		} else {
+			add("ProxyCommand", strings.TrimPrefix(args[1], "ProxyCommand="))
+		}
+	}
+	for _, fw := range conf.forwards() {
+		if err := fw.validate(); err != nil {
+			return "", fmt.Errorf("%s: %s", conf.Name, err.Error())
+		}
+		if len(fw.Label) > 0 {
+			lines = append(lines, "    # "+fw.Label)
+		}
+		add("LocalForward", fw.local()+" "+fw.remote())
+	}
+	for _, fw := range conf.RemoteForwards {
+		remote := fw.RemotePort
+		if len(fw.RemoteBindAddress) > 0 {
+			remote = fw.remote()
+		}
+		add("RemoteForward", remote+" "+fw.local())
+	}
+	for _, port := range conf.DynamicForwards {
+		add("DynamicForward", net.JoinHostPort(conf.LocalBindAddress, port))
+	}
+	add("ExitOnForwardFailure", "yes")
+	return strings.Join(lines, "\n") + "\n", nil
+}
+
+func sshConfigQuote(value string) string {
+	if strings.ContainsAny(value, " \t") {
+		return `"` + value + `"`
+	}
+	return value
+}
+
+// runExport prints configs as ssh_config Host blocks, or writes them to a
+// managed file that the user's ssh config can Include
+func runExport(configPath string, args []string) error {
+	flags := flag.NewFlagSet("export-ssh-config", flag.ContinueOnError)
+	include := flags.Bool("include", false, "write the managed include file "+managedIncludeFile)
+	output := flags.String("o", managedIncludeFile, "path of the managed include file")
+	err := flags.Parse(args)
+	if err != nil {
+		return usageError("sshtunnel export-ssh-config [-include] [-o file] [name...]")
+	}
+
+	names := flags.Args()
+	if len(names) == 0 {
+		names, err = configNames(configPath)
+		if err != nil {
+			return err
+		}
+	}
+
+	blocks := []string{}
+	for _, name := range names {
+		conf, err := loadConfig(configPath, name)
+		if err != nil {
+			return err
+		}
+		block, err := renderSSHHost(conf)
+		if err != nil {
+			return err
+		}
+		blocks = append(blocks, block)
+	}
+	content := strings.Join(blocks, "\n")
+
+	if !*include {
+		fmt.Print(content)
+		return nil
+	}
+
+	path := expandHome(*output)
+	err = os.MkdirAll(filepath.Dir(path), 0700)
+	if err != nil {
+		return err
+	}
+	err = ioutil.WriteFile(path, []byte(managedIncludeHeader+"\n"+content), 0600)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("wrote %d hosts to %s\n", len(names), path)
+	if !included(expandHome(defaultSSHConfig), path) {
+		fmt.Printf("add this line to the top of %s to use them:\nInclude %s\n", defaultSSHConfig, path)
+	}
+	return nil
+}
+
+// included reports if an ssh_config file already includes path
+func included(configFile, path string) bool {
+	bt, err := ioutil.ReadFile(configFile)
+	if err != nil {
+		return false
+	}
+	for _, line := range strings.Split(string(bt), "\n") {
+		keyword, args := splitSSHConfigLine(line)
+		if keyword != "include" {
+			continue
+		}
+		for _, pattern := range args {
+			pattern = expandHome(pattern)
+			if !filepath.IsAbs(pattern) {
+				pattern = filepath.Join(expandHome("~/.ssh"), pattern)
+			}
+			if matched, _ := filepath.Match(pattern, path); matched {
+				return true
+			}
+		}
+	}
+	return false
+}
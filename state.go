@@ -0,0 +1,254 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	stateFolder = "state"
+	// lstart only has a resolution of one second
+	startTimeTolerance = 5 * time.Second
+)
+
+// record is what is known about a tunnel process started by sshtunnel
+type record struct {
+	Name       string    `json:"name"`
+	PID        int       `json:"pid"`
+	StartTime  time.Time `json:"startTime"`
+	ConfigHash string    `json:"configHash"`
+	Argv       []string  `json:"argv"`
+}
+
+func recordPath(dataPath, name string) string {
+	return dataPath + "/" + stateFolder + "/" + name + ".json"
+}
+
+func readRecord(dataPath, name string) (record, error) {
+	var rec record
+	bt, err := ioutil.ReadFile(recordPath(dataPath, name))
+	if err != nil {
+		return rec, err
+	}
+	err = json.Unmarshal(bt, &rec)
+	return rec, err
+}
+
+func writeRecord(dataPath string, rec record) error {
+	err := os.MkdirAll(dataPath+"/"+stateFolder, os.ModePerm)
+	if err != nil {
+		return err
+	}
+	bt, err := json.MarshalIndent(rec, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(recordPath(dataPath, rec.Name), bt, 0644)
+}
+
+func removeRecord(dataPath, name string) {
+	os.Remove(recordPath(dataPath, name))
+}
+
+// alive checks that the recorded PID is still running and still belongs to
+// the recorded command, so a reused PID is never reported or killed
+func (r record) alive() bool {
+	if r.PID <= 0 {
+		return false
+	}
+	cmd := exec.Command("ps", "-ww", "-o", "lstart=,command=", "-p", strconv.Itoa(r.PID))
+	// lstart is written in the user's locale otherwise
+	cmd.Env = append(os.Environ(), "LC_ALL=C")
+	out, err := cmd.Output()
+	if err != nil {
+		return false
+	}
+	fields := strings.Fields(string(out))
+	if len(fields) < 6 {
+		return false
+	}
+	started, err := time.ParseInLocation("Mon Jan 2 15:04:05 2006", strings.Join(fields[:5], " "), time.Local)
+	if err != nil {
+		return false
+	}
+	diff := started.Sub(r.StartTime)
+	if diff < -startTimeTolerance || diff > startTimeTolerance {
+		return false
+	}
+	return strings.Join(fields[5:], " ") == strings.Join(strings.Fields(strings.Join(r.Argv, " ")), " ")
+}
+
+// configHash identifies the content of a config, to tell if a running
+// tunnel was started with an older version of it
+func configHash(conf Config) string {
+	bt, _ := yaml.Marshal(conf)
+	sum := sha256.Sum256(bt)
+	return hex.EncodeToString(sum[:])
+}
+
+// tunnelArgv returns the command that runs a tunnel in the foreground and
+// logs its output
+func tunnelArgv(conf Config) []string {
+	exe, _ := os.Executable()
+	return []string{exe, "tunnel", conf.Name}
+}
+
+// startProcess starts a tunnel detached from the current process and
+// records it
+func startProcess(dataPath string, conf Config) error {
+	if rec, err := readRecord(dataPath, conf.Name); err == nil && rec.alive() {
+		return fmt.Errorf("%s is already running", conf.Name)
+	}
+
+	argv := tunnelArgv(conf)
+	cmd := exec.Command(argv[0], argv[1:]...)
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	err := cmd.Start()
+	if err != nil {
+		return err
+	}
+	defer cmd.Process.Release()
+
+	return writeRecord(dataPath, record{
+		Name:       conf.Name,
+		PID:        cmd.Process.Pid,
+		StartTime:  time.Now(),
+		ConfigHash: configHash(conf),
+		Argv:       argv,
+	})
+}
+
+// stopProcess stops a recorded tunnel and everything it started
+func stopProcess(dataPath, name string) error {
+	rec, err := readRecord(dataPath, name)
+	if err != nil {
+		return fmt.Errorf("%s is not running", name)
+	}
+	defer removeRecord(dataPath, name)
+	if !rec.alive() {
+		return fmt.Errorf("%s is not running", name)
+	}
+	err = syscall.Kill(-rec.PID, syscall.SIGTERM)
+	if err == syscall.ESRCH {
+		// not the leader of its own process group, so only it can be stopped
+		err = syscall.Kill(rec.PID, syscall.SIGTERM)
+	}
+	return err
+}
+
+// recordStatus reports a tunnel's state from its record
+func recordStatus(dataPath string, conf Config) tunnelStatus {
+	status := tunnelStatus{Name: conf.Name, State: stateOff}
+	rec, err := readRecord(dataPath, conf.Name)
+	if err != nil || !rec.alive() {
+		return status
+	}
+	status.State = stateOn
+	status.PID = rec.PID
+	status.Since = rec.StartTime
+	status.ConfigChanged = rec.ConfigHash != configHash(conf)
+	return status
+}
+
+// unloadableStatus reports a tunnel whose config can't be loaded with the
+// reason, still from its record if it is running
+func unloadableStatus(dataPath, name string, err error) tunnelStatus {
+	status := recordStatus(dataPath, Config{Name: name})
+	// the hash of a config that can't be loaded tells nothing
+	status.ConfigChanged = false
+	status.LastError = strings.TrimPrefix(err.Error(), name+": ")
+	return status
+}
+
+// runDirect does what the daemon would do for a command when it is not
+// running
+func runDirect(dataPath, configPath, command, name string) ([]tunnelStatus, error) {
+	names := []string{name}
+	if len(name) == 0 {
+		var err error
+		names, err = configNames(configPath)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	statuses := []tunnelStatus{}
+	for _, name := range names {
+		conf, err := loadConfig(configPath, name)
+		if err != nil {
+			// a tunnel is shown and stopped without its config, so a broken
+			// one doesn't hide the others or keep running
+			switch command {
+			case "stop":
+				if err := stopProcess(dataPath, name); err != nil {
+					return nil, err
+				}
+			case "status":
+			default:
+				return nil, err
+			}
+			statuses = append(statuses, unloadableStatus(dataPath, name, err))
+			continue
+		}
+
+		switch command {
+		case "start":
+			err = checkConfig(conf)
+			if err == nil {
+				err = checkPortsError(configPath, conf)
+			}
+			if err == nil {
+				err = startProcess(dataPath, conf)
+			}
+		case "stop":
+			err = stopProcess(dataPath, name)
+		case "restart":
+			err = checkConfig(conf)
+			if err == nil {
+				stopProcess(dataPath, name)
+				// give the old process time to release its ports
+				time.Sleep(time.Second)
+				err = checkPortsError(configPath, conf)
+			}
+			if err == nil {
+				err = startProcess(dataPath, conf)
+			}
+		case "status":
+		default:
+			err = fmt.Errorf("unknown command %q", command)
+		}
+		if err != nil {
+			return nil, err
+		}
+		statuses = append(statuses, recordStatus(dataPath, conf))
+	}
+	return statuses, nil
+}
+
+// currentStatus returns the state of every configured tunnel, from the
+// daemon when it is running or from the records otherwise
+func currentStatus(dataPath, configPath string) (map[string]tunnelStatus, error) {
+	statuses := map[string]tunnelStatus{}
+	resp, err := daemonRequest(dataPath, request{Command: "status"})
+	if err == errDaemonNotRunning {
+		resp.Tunnels, err = runDirect(dataPath, configPath, "status", "")
+	}
+	if err != nil {
+		return statuses, err
+	}
+	for _, status := range resp.Tunnels {
+		statuses[status.Name] = status
+	}
+	return statuses, nil
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// problem is something wrong with one field of a config
+type problem struct {
+	Field   string
+	Message string
+}
+
+func (p problem) String() string {
+	return p.Field + ": " + p.Message
+}
+
+var strictHostKeyCheckingValues = []string{"yes", "no", "ask", "accept-new", "off"}
+
+// validate returns every problem with a config, a config without problems
+// can be started
+func validate(conf Config) []problem {
+	problems := []problem{}
+	add := func(field, format string, args ...interface{}) {
+		problems = append(problems, problem{Field: field, Message: fmt.Sprintf(format, args...)})
+	}
+
+	if len(conf.LocalBindAddress) == 0 {
+		add("LocalBindAddress", "is required")
+	} else if net.ParseIP(conf.LocalBindAddress) == nil {
+		add("LocalBindAddress", "%q is not an IP address", conf.LocalBindAddress)
+	}
+	if len(conf.RemoteUser) == 0 {
+		add("RemoteUser", "is required")
+	} else if !validUser(conf.RemoteUser) {
+		add("RemoteUser", "%q is not a valid user", conf.RemoteUser)
+	}
+	if len(conf.RemoteHost) == 0 {
+		add("RemoteHost", "is required")
+	} else if !validHost(conf.RemoteHost) {
+		add("RemoteHost", "%q is not a valid host", conf.RemoteHost)
+	}
+	if len(conf.RemotePort) > 0 && !validPort(conf.RemotePort) {
+		add("RemotePort", "%q is not a valid port", conf.RemotePort)
+	}
+	if len(conf.IdentityFile) > 0 && !fileExists(conf.IdentityFile) {
+		add("IdentityFile", "%s does not exist", conf.IdentityFile)
+	}
+	if conf.ServerAliveInterval < 0 {
+		add("ServerAliveInterval", "must not be negative")
+	}
+	if conf.ServerAliveCountMax < 0 {
+		add("ServerAliveCountMax", "must not be negative")
+	}
+	if len(conf.StrictHostKeyChecking) > 0 && !contains(strictHostKeyCheckingValues, strings.ToLower(conf.StrictHostKeyChecking)) {
+		add("StrictHostKeyChecking", "%q is not one of %s", conf.StrictHostKeyChecking, strings.Join(strictHostKeyCheckingValues, ", "))
+	}
+
+	switch conf.Backend {
+	case "", backendAutossh:
+	case backendNative:
+		if len(conf.ProxyCommand) > 0 {
+			add("ProxyCommand", "is not supported by the native backend")
+		}
+	default:
+		add("Backend", "%q is not one of %s, %s", conf.Backend, backendAutossh, backendNative)
+	}
+	problems = append(problems, conf.Reconnect.validate()...)
+	for i, name := range conf.DependsOn {
+		if len(name) == 0 || strings.ContainsAny(name, "/ ") {
+			add(fmt.Sprintf("DependsOn[%d]", i), "%q is not a valid config name", name)
+		}
+	}
+	for i, name := range conf.Groups {
+		if len(name) == 0 || strings.ContainsAny(name, "/ ") {
+			add(fmt.Sprintf("Groups[%d]", i), "%q is not a valid group name", name)
+		}
+	}
+	if len(conf.JumpHosts) > 0 && len(conf.ProxyCommand) > 0 {
+		add("JumpHosts", "can't be combined with ProxyCommand")
+	}
+	for i, hop := range conf.JumpHosts {
+		field := fmt.Sprintf("JumpHosts[%d]", i)
+		if !validHost(hop.Host) {
+			add(field, "%q is not a valid host", hop.Host)
+		}
+		if len(hop.User) > 0 && !validUser(hop.User) {
+			add(field, "%q is not a valid user", hop.User)
+		}
+		if len(hop.Port) > 0 && !validPort(hop.Port) {
+			add(field, "%q is not a valid port", hop.Port)
+		}
+		if len(hop.IdentityFile) > 0 && !fileExists(hop.IdentityFile) {
+			add(field, "%s does not exist", hop.IdentityFile)
+		}
+	}
+
+	// every local endpoint can only be listened on once
+	endpoints := map[string]string{}
+	listen := func(field, endpoint string) {
+		if other, ok := endpoints[endpoint]; ok {
+			add(field, "%s is already forwarded by %s", endpoint, other)
+			return
+		}
+		endpoints[endpoint] = field
+	}
+	for i, fw := range conf.forwards() {
+		field := fmt.Sprintf("ForwardPorts[%d]", i)
+		if err := fw.validate(); err != nil {
+			add(field, "%s", err.Error())
+			continue
+		}
+		listen(field, fw.local())
+	}
+	for i, port := range conf.DynamicForwards {
+		field := fmt.Sprintf("DynamicForwards[%d]", i)
+		if !validPort(port) {
+			add(field, "%q is not a valid port", port)
+			continue
+		}
+		listen(field, net.JoinHostPort(conf.LocalBindAddress, port))
+	}
+
+	remoteEndpoints := map[string]string{}
+	for i, fw := range conf.RemoteForwards {
+		field := fmt.Sprintf("RemoteForwards[%d]", i)
+		if !validPort(fw.RemotePort) {
+			add(field, "invalid remote port %q", fw.RemotePort)
+			continue
+		}
+		if !validPort(fw.LocalPort) {
+			add(field, "invalid local port %q", fw.LocalPort)
+			continue
+		}
+		if !validHost(fw.localHost()) {
+			add(field, "invalid local host %q", fw.LocalHost)
+			continue
+		}
+		// ssh takes * or an empty address for every interface of the remote
+		// host
+		if bind := fw.RemoteBindAddress; len(bind) > 0 && bind != "*" && !validHost(bind) {
+			add(field, "invalid remote bind address %q", bind)
+			continue
+		}
+		if other, ok := remoteEndpoints[fw.remote()]; ok {
+			add(field, "%s is already forwarded by %s", fw.remote(), other)
+			continue
+		}
+		remoteEndpoints[fw.remote()] = field
+	}
+	return problems
+}
+
+// hasProblem tells if any of the problems is with field
+func hasProblem(problems []problem, field string) bool {
+	for _, p := range problems {
+		if p.Field == field {
+			return true
+		}
+	}
+	return false
+}
+
+// checkConfig returns the first problem with a config as an error
+func checkConfig(conf Config) error {
+	problems := validate(conf)
+	if len(problems) > 0 {
+		return fmt.Errorf("%s: %s", conf.Name, problems[0])
+	}
+	return nil
+}
+
+// validPort checks that a port is a number between 1 and 65535
+func validPort(port string) bool {
+	n, err := strconv.Atoi(port)
+	return err == nil && n > 0 && n <= 65535
+}
+
+// validHost checks that a host is an IP address or a host name
+func validHost(host string) bool {
+	if net.ParseIP(host) != nil {
+		return true
+	}
+	if len(host) == 0 || len(host) > 253 {
+		return false
+	}
+	for _, label := range strings.Split(host, ".") {
+		if len(label) == 0 || len(label) > 63 || strings.HasPrefix(label, "-") {
+			return false
+		}
+		for _, r := range label {
+			if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_') {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// validUser checks that a user can't be taken for an ssh option or end up
+// as part of the host
+func validUser(user string) bool {
+	if strings.HasPrefix(user, "-") {
+		return false
+	}
+	return strings.IndexFunc(user, func(r rune) bool {
+		return unicode.IsSpace(r) || unicode.IsControl(r) || strings.ContainsRune("@:,", r)
+	}) < 0
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(expandHome(path))
+	return err == nil
+}
+
+func contains(list []string, str string) bool {
+	for _, item := range list {
+		if item == str {
+			return true
+		}
+	}
+	return false
+}
+
+// runValidate prints every problem of the named config, or of every config
+// and group, and fails if there are any
+func runValidate(dataPath, configPath, name string) error {
+	names := []string{name}
+	if len(name) == 0 {
+		var err error
+		names, err = configNames(configPath)
+		if err != nil {
+			return err
+		}
+	}
+
+	count := 0
+	for _, name := range names {
+		conf, err := loadConfig(configPath, name)
+		if err != nil {
+			// the error already names the config
+			fmt.Println(err.Error())
+			count++
+			continue
+		}
+		problems := validate(conf)
+		for i, dep := range conf.DependsOn {
+			if _, err := readConfig(configPath, dep); err != nil {
+				problems = append(problems, problem{fmt.Sprintf("DependsOn[%d]", i), dep + " does not exist"})
+			}
+		}
+		if len(problems) == 0 {
+			fmt.Printf("%s: ok\n", name)
+		}
+		for _, problem := range problems {
+			fmt.Printf("%s: %s\n", name, problem)
+		}
+		count += len(problems)
+	}
+	if len(name) == 0 {
+		groups, err := loadGroups(dataPath, configPath)
+		if err != nil {
+			return err
+		}
+		for _, g := range groups {
+			for _, member := range g.Members {
+				if !contains(names, member) {
+					fmt.Printf("group %s: %s does not exist\n", g.Name, member)
+					count++
+				}
+			}
+		}
+	}
+	switch {
+	case count == 1:
+		return fmt.Errorf("1 problem found")
+	case count > 1:
+		return fmt.Errorf("%d problems found", count)
+	}
+	return nil
+}
@@ -0,0 +1,83 @@
+package main
+
+import "testing"
+
+func TestValidUser(t *testing.T) {
+	tests := []struct {
+		user string
+		want bool
+	}{
+		{"deploy", true},
+		{"first.last", true},
+		{"user_1", true},
+		{"dom$ain", true},
+		{"", true},
+		{"-oProxyCommand=touch /tmp/pwned", false},
+		{"-l", false},
+		{"root@evil.com", false},
+		{"a b", false},
+		{"tab\there", false},
+		{"line\nbreak", false},
+		{"nul\x00", false},
+		{"host:22", false},
+		{"a,b", false},
+	}
+	for _, test := range tests {
+		if got := validUser(test.user); got != test.want {
+			t.Errorf("validUser(%q) = %v, want %v", test.user, got, test.want)
+		}
+	}
+}
+
+func TestValidHost(t *testing.T) {
+	tests := []struct {
+		host string
+		want bool
+	}{
+		{"example.com", true},
+		{"db-1.internal", true},
+		{"my_host", true},
+		{"127.0.0.1", true},
+		{"::1", true},
+		{"", false},
+		{"-oProxyCommand=touch", false},
+		{"-p", false},
+		{"a.-b", false},
+		{"a..b", false},
+		{"$(touch /tmp/pwned)", false},
+		{"`id`", false},
+		{"a;b", false},
+		{"'quoted'", false},
+		{"line\nbreak", false},
+		{"user@host", false},
+		{"host:22", false},
+		{"a b", false},
+	}
+	for _, test := range tests {
+		if got := validHost(test.host); got != test.want {
+			t.Errorf("validHost(%q) = %v, want %v", test.host, got, test.want)
+		}
+	}
+}
+
+func TestValidateHostileConfig(t *testing.T) {
+	conf := Config{
+		host: host{
+			RemoteUser: "-oProxyCommand=touch /tmp/pwned",
+			RemoteHost: "$(touch /tmp/pwned)",
+			RemotePort: "22; id",
+			JumpHosts:  []jumpHost{{User: "a b", Host: "-J"}},
+		},
+		LocalBindAddress: "127.0.0.1",
+	}
+	counts := map[string]int{}
+	for _, p := range validate(conf) {
+		counts[p.Field]++
+	}
+	want := map[string]int{"RemoteUser": 1, "RemoteHost": 1, "RemotePort": 1, "JumpHosts[0]": 2}
+	for field, n := range want {
+		if counts[field] != n {
+			t.Errorf("validate reported %d problems of %s, want %d", counts[field], field, n)
+		}
+	}
+}
@@ -0,0 +1,16 @@
+#!/bin/sh
+# build.sh builds sshtunnel for Intel and Apple silicon Macs and puts the
+# universal binary and the icons into the workflow bundle. info.plist in the
+# bundle is edited with Alfred and left as it is.
+set -e
+
+cd "$(dirname "$0")/.."
+bundle="workflow/SSH Tunnel.alfredworkflow"
+build=$(mktemp -d)
+trap 'rm -rf "$build"' EXIT
+
+GOOS=darwin GOARCH=amd64 go build -trimpath -ldflags "-s -w" -o "$build/sshtunnel-amd64" .
+GOOS=darwin GOARCH=arm64 go build -trimpath -ldflags "-s -w" -o "$build/sshtunnel-arm64" .
+lipo -create -output "$build/sshtunnel" "$build/sshtunnel-amd64" "$build/sshtunnel-arm64"
+
+zip -j -q "$bundle" "$build/sshtunnel" *.png